@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A file in the export archive, made from a query that returns a
+// json value built out of the data the user with the id $1 owns.
+// Every table holding user data should be in both the export and
+// deleteAccount, so we never keep data we can't account for
+type exportFile struct {
+	name  string
+	query string
+}
+
+var exportFiles = []exportFile{
+	{"account.json", `
+		select row_to_json(t) from (
+			select ID as "id", Email as "email", VerifiedAt as "verifiedAt",
+			TOTPEnabled as "twoFactorEnabled", Plan as "plan"
+			from Users where ID = $1
+		) t`},
+	{"decks.json", `
+		select coalesce(json_agg(t order by t."id"), '[]') from (
+			select d.ID as "id", d.Name as "name", d.Description as "description",
+			d.Subject as "subject", d.Language as "language", d.FolderID as "folderId",
+			d.CoverAsset as "coverAsset", d.Published as "published",
+			d.PublishedAt as "publishedAt", d.Copies as "copies", d.Version as "version",
+			d.CreatedAt as "createdAt", d.UpdatedAt as "updatedAt", d.DeletedAt as "deletedAt",
+			array(
+				select tg.Name from DeckTags dt join Tags tg on tg.ID = dt.TagID
+				where dt.DeckID = d.ID order by tg.Name
+			) as "tags",
+			(
+				select coalesce(json_agg(c order by c."position", c."id"), '[]') from (
+					select f.ID as "id", f.Front as "front", f.Back as "back",
+					f.Position as "position", f.Version as "version",
+					f.CreatedAt as "createdAt", f.UpdatedAt as "updatedAt",
+					f.DeletedAt as "deletedAt", f.Due as "due", f.Stability as "stability",
+					f.Difficulty as "difficulty", f.Reps as "reps", f.Lapses as "lapses",
+					f.LastReview as "lastReview",
+					array(
+						select tg.Name from CardTags ct join Tags tg on tg.ID = ct.TagID
+						where ct.CardID = f.ID order by tg.Name
+					) as "tags"
+					from Flashcards f where f.DeckID = d.ID
+				) c
+			) as "cards"
+			from Decks d where d.UserID = $1
+		) t`},
+	{"folders.json", `
+		select coalesce(json_agg(t order by t."id"), '[]') from (
+			select ID as "id", ParentID as "parentId", Name as "name"
+			from Folders where UserID = $1
+		) t`},
+	{"tags.json", `
+		select coalesce(json_agg(t order by t."name"), '[]') from (
+			select ID as "id", Name as "name" from Tags where UserID = $1
+		) t`},
+	{"card-revisions.json", `
+		select coalesce(json_agg(t order by t."id"), '[]') from (
+			select ID as "id", CardID as "cardId", Action as "action",
+			FrontBefore as "frontBefore", BackBefore as "backBefore",
+			FrontAfter as "frontAfter", BackAfter as "backAfter", CreatedAt as "createdAt"
+			from CardRevisions where UserID = $1
+		) t`},
+	{"explanations.json", `
+		select coalesce(json_agg(t order by t."cardId"), '[]') from (
+			select e.CardID as "cardId", e.Explanation as "explanation",
+			e.Hints as "hints", e.CreatedAt as "createdAt"
+			from CardExplanations e
+			join Flashcards f on f.ID = e.CardID
+			join Decks d on d.ID = f.DeckID
+			where d.UserID = $1
+		) t`},
+	{"reviews.json", `
+		select coalesce(json_agg(t order by t."reviewedAt", t."id"), '[]') from (
+			select ID as "id", CardID as "cardId", Rating as "rating",
+			ElapsedMs as "elapsedMs", ReviewedAt as "reviewedAt", SessionID as "sessionId"
+			from Reviews where UserID = $1
+		) t`},
+	{"study-sessions.json", `
+		select coalesce(json_agg(t order by t."id"), '[]') from (
+			select ID as "id", CardIDs as "cardIds",
+			CreatedAt as "createdAt", EndedAt as "endedAt"
+			from StudySessions where UserID = $1
+		) t`},
+	{"scheduling-parameters.json", `
+		select row_to_json(t) from (
+			select Parameters as "parameters", Status as "status",
+			ReviewCount as "reviewCount", UpdatedAt as "updatedAt",
+			OptimizedAt as "optimizedAt"
+			from UserParameters where UserID = $1
+		) t`},
+	{"sessions.json", `
+		select coalesce(json_agg(t order by t."createdAt"), '[]') from (
+			select ID as "id", UserAgent as "userAgent", IPAddress as "ipAddress",
+			CreatedAt as "createdAt", LastSeenAt as "lastSeenAt", RevokedAt as "revokedAt"
+			from Sessions where UserID = $1
+		) t`},
+	{"identities.json", `
+		select coalesce(json_agg(t order by t."createdAt"), '[]') from (
+			select Provider as "provider", Subject as "subject", Email as "email",
+			CreatedAt as "createdAt", LastLoginAt as "lastLoginAt"
+			from ExternalIdentities where UserID = $1
+		) t`},
+	{"deck-flags.json", `
+		select coalesce(json_agg(t order by t."createdAt"), '[]') from (
+			select DeckID as "deckId", Reason as "reason", CreatedAt as "createdAt"
+			from DeckFlags where UserID = $1
+		) t`},
+	{"sync-mutations.json", `
+		select coalesce(json_agg(t order by t."createdAt"), '[]') from (
+			select ClientID as "clientId", ServerID as "serverId", Status as "status",
+			Reason as "reason", CreatedAt as "createdAt"
+			from SyncMutations where UserID = $1
+		) t`},
+	{"usage.json", `
+		select coalesce(json_agg(t order by t."createdAt", t."id"), '[]') from (
+			select ID as "id", Action as "action", PromptTokens as "promptTokens",
+			CompletionTokens as "completionTokens", TotalTokens as "totalTokens",
+			Images as "images", CreatedAt as "createdAt"
+			from UsageLedger where UserID = $1
+		) t`},
+	{"assets.json", `
+		select coalesce(json_agg(t order by t."createdAt"), '[]') from (
+			select ID as "id", DeckID as "deckId", Mimetype as "mimetype",
+			CreatedAt as "createdAt"
+			from Assets where UserID = $1
+		) t`},
+}
+
+var ErrReauthenticationFailed error = fmt.Errorf("incorrect password or code")
+
+// The name of an asset's file in the export archive
+func assetFilename(id, mimetype string) string {
+	extension := "bin"
+	if kind, subtype, found := strings.Cut(mimetype, "/"); found && kind == "image" {
+		extension = strings.TrimPrefix(subtype, "x-")
+	}
+	return fmt.Sprintf("assets/%s.%s", id, extension)
+}
+
+// Write everything we hold about the user into a zip archive. It's all
+// read in one read only transaction, so the files are consistent
+func (db *Database) exportAccount(userId string, archive *zip.Writer) error {
+	options := pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+	tx, err := db.pool.BeginTx(context.Background(), options)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	for _, file := range exportFiles {
+		var data json.RawMessage
+		err := tx.QueryRow(context.Background(), file.query, userId).Scan(&data)
+		if err == pgx.ErrNoRows {
+			data = json.RawMessage("null")
+		} else if err != nil {
+			return err
+		}
+
+		writer, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+
+	// Assets can be big, so they're read one at a time
+	var ids []string
+	str := "select coalesce(array_agg(ID order by CreatedAt), '{}') from Assets where UserID = $1"
+	if err := tx.QueryRow(context.Background(), str, userId).Scan(&ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var asset Asset
+		str := "select Mimetype, Data from Assets where ID = $1"
+		err := tx.QueryRow(context.Background(), str, id).Scan(&asset.Mimetype, &asset.Data)
+		if err != nil {
+			return err
+		}
+
+		writer, err := archive.Create(assetFilename(id, asset.Mimetype))
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(asset.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete the user along with everything they own in one transaction,
+// returning the ids of the sessions that were deleted. Users with two-factor
+// authentication need to provide a code too. Copies other users made of the
+// user's published decks belong to them, so they're kept
+func (db *Database) deleteAccount(userId, code string) ([]string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var totpEnabled bool
+	str := "select TOTPEnabled from Users where ID = $1 for update"
+	err = tx.QueryRow(context.Background(), str, userId).Scan(&totpEnabled)
+	if err == pgx.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if totpEnabled {
+		err := checkSecondFactor(tx, userId, code, true, true)
+		if err == ErrInvalidCode {
+			return nil, ErrReauthenticationFailed
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	var deckIds, cardIds []int
+	var sessionIds []string
+	str = "select coalesce(array_agg(ID), '{}') from Decks where UserID = $1"
+	if err := tx.QueryRow(context.Background(), str, userId).Scan(&deckIds); err != nil {
+		return nil, err
+	}
+
+	str = "select coalesce(array_agg(ID), '{}') from Flashcards where DeckID = any($1)"
+	if err := tx.QueryRow(context.Background(), str, deckIds).Scan(&cardIds); err != nil {
+		return nil, err
+	}
+
+	str = "select coalesce(array_agg(ID), '{}') from Sessions where UserID = $1"
+	if err := tx.QueryRow(context.Background(), str, userId).Scan(&sessionIds); err != nil {
+		return nil, err
+	}
+
+	statements := []struct {
+		str string
+		arg any
+	}{
+		{"delete from CardTags where CardID = any($1)", cardIds},
+		{"delete from CardExplanations where CardID = any($1)", cardIds},
+		{"delete from Flashcards where ID = any($1)", cardIds},
+		{"delete from DeckTags where DeckID = any($1)", deckIds},
+		// Other users' flags on the user's decks, and the user's flags on other decks
+		{"delete from DeckFlags where DeckID = any($1)", deckIds},
+		{"delete from DeckFlags where UserID = $1", userId},
+		{"delete from Decks where ID = any($1)", deckIds},
+		{"delete from CardRevisions where UserID = $1", userId},
+		{"delete from Reviews where UserID = $1", userId},
+		{"delete from StudySessions where UserID = $1", userId},
+		{"delete from UserParameters where UserID = $1", userId},
+		{"delete from UsageLedger where UserID = $1", userId},
+		{"delete from Assets where UserID = $1", userId},
+		{"delete from Folders where UserID = $1", userId},
+		{"delete from Tags where UserID = $1", userId},
+		{"delete from Tombstones where UserID = $1", userId},
+		{"delete from SyncMutations where UserID = $1", userId},
+		{"delete from RefreshTokens where UserID = $1", userId},
+		{"delete from Sessions where UserID = $1", userId},
+		{"delete from EmailTokens where UserID = $1", userId},
+		{"delete from RecoveryCodes where UserID = $1", userId},
+		{"delete from ExternalIdentities where UserID = $1", userId},
+		{"delete from OIDCStates where LinkUserID = $1", userId},
+		{`delete from LoginAttempts where Key = '2fa:' || $1::text or Key in (
+			select 'account:' || lower(trim(Email)) from Users where ID = $1
+		)`, userId},
+		{"delete from RateLimitBuckets where Key like '%|user:' || $1::text", userId},
+		{"delete from Users where ID = $1", userId},
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(context.Background(), s.str, s.arg); err != nil {
+			return nil, err
+		}
+	}
+
+	return sessionIds, tx.Commit(context.Background())
+}
+
+// Respond with a zip archive of json files holding
+// everything we store about the user, along with their assets
+func (app *App) ExportAccount(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	ctx.Header("Content-Type", "application/zip")
+	ctx.Header("Content-Disposition", `attachment; filename="snapcram-export.zip"`)
+	ctx.Status(http.StatusOK)
+
+	// The archive is streamed, so errors can only cut the response short
+	archive := zip.NewWriter(ctx.Writer)
+	if err := app.db.exportAccount(userId, archive); err != nil {
+		log.Printf("exporting the data of %s failed: %v", userId, err)
+		ctx.Abort()
+		return
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("exporting the data of %s failed: %v", userId, err)
+	}
+}
+
+type DeleteAccountData struct {
+	Password string `json:"password" binding:"required"`
+	// Required when two-factor authentication is enabled
+	Code string `json:"code"`
+}
+
+// Permanently delete the user's account, after they confirm it's them by
+// entering their password (and code). Users that only sign in through an
+// identity provider can set a password by resetting it
+func (app *App) DeleteAccount(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data DeleteAccountData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	email, _, err := app.db.getUserEmail(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	// Re-authenticating is throttled like logging in, so a stolen
+	// access token can't be used to guess the password or code
+	accountKey, userKey := accountThrottleKey(email), secondFactorThrottleKey(userId)
+	attempt, ok := app.reserveAttempt(ctx, accountKey, userKey)
+	if !ok {
+		return
+	}
+	// The keys the attempt failed for, it's forgiven for the others
+	var failed []throttleKey
+	defer func() { app.settleAttempt(attempt, failed...) }()
+
+	passwordUserId, err := app.db.validateUserCredentials(email, data.Password)
+	if err == ErrWrongPassword || (err == nil && passwordUserId != userId) {
+		failed = []throttleKey{accountKey}
+		handleResponse(ctx, http.StatusUnauthorized, ErrReauthenticationFailed.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	// The failures of both keys are cleared along with the account
+	sessionIds, err := app.db.deleteAccount(userId, data.Code)
+	if err == ErrReauthenticationFailed {
+		failed = []throttleKey{userKey}
+		handleResponse(ctx, http.StatusUnauthorized, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	for _, id := range sessionIds {
+		app.sessions.set(id, true)
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Assets are the images flashcards get generated from. They're uploaded
+// before their deck exists, so they only get attached to a deck once it's
+// created. Unattached assets are eventually purged
+type Asset struct {
+	ID       string
+	Mimetype string
+	Data     []byte
+}
+
+var ErrAssetNotFound error = fmt.Errorf("asset not found")
+
+// Store the uploaded files and return their ids
+func (db *Database) insertAssets(userId string, files []*multipart.FileHeader) ([]string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	ids := []string{}
+	for _, file := range files {
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		id := uuid.NewString()
+		str := "insert into Assets (ID, UserID, Mimetype, Data) values ($1, $2, $3, $4)"
+		_, err = tx.Exec(
+			context.Background(), str, id, userId, file.Header.Get("Content-Type"), data)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, tx.Commit(context.Background())
+}
+
+// Attach the user's unattached assets to a deck
+func attachAssets(tx pgx.Tx, userId string, deckId int, assetIds []string) error {
+	str := `
+		update Assets set DeckID = $3
+		where UserID = $1 and ID = any($2) and DeckID is null`
+	_, err := tx.Exec(context.Background(), str, userId, assetIds, deckId)
+	return err
+}
+
+// Get an asset that belongs to the user, or that is
+// the cover of a deck in the public library
+func (db *Database) getAsset(userId, assetId string) (Asset, error) {
+	asset := Asset{ID: assetId}
+	str := `
+		select a.Mimetype, a.Data from Assets a
+		where a.ID = $2 and (a.UserID = $1 or exists (
+			select 1 from Decks d
+			where d.CoverAsset = a.ID and d.Published
+			and not d.Hidden and d.DeletedAt is null
+		))`
+	err := db.pool.QueryRow(context.Background(), str, userId, assetId).Scan(
+		&asset.Mimetype, &asset.Data)
+	if err == pgx.ErrNoRows {
+		return Asset{}, ErrAssetNotFound
+	}
+	return asset, err
+}
+
+func (app *App) GetAsset(ctx *gin.Context) {
+	// Anyone can see the covers of published decks
+	userId, _ := app.getUserID(ctx)
+
+	asset, err := app.db.getAsset(userId, ctx.Param("id"))
+	if err == ErrAssetNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	ctx.Data(http.StatusOK, asset.Mimetype, asset.Data)
+}
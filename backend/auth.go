@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Refresh tokens are random strings that are only stored hashed. Each one
+// can only be used once: using it returns a new refresh token from the same
+// family, which holds every token descending from the same login (the family
+// id is the id of the login's session). If a used token is presented again,
+// it was stolen (or the real client was), so the whole family and its session
+// get revoked and the user has to log in again
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+var ErrRefreshTokenInvalid error = fmt.Errorf("invalid refresh token")
+var ErrRefreshTokenReused error = fmt.Errorf("refresh token was already used")
+
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	// The number of seconds until the access token expires
+	ExpiresIn int `json:"expiresIn"`
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Generate a random url safe token
+func generateToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func (db *Database) insertRefreshToken(userId, familyId, hash string) error {
+	str := `
+		insert into RefreshTokens (Hash, UserID, FamilyID, ExpiresAt)
+		values ($1, $2, $3, $4)`
+	_, err := db.pool.Exec(
+		context.Background(), str, hash, userId, familyId,
+		time.Now().Add(refreshTokenLifetime),
+	)
+	return err
+}
+
+// Use up a refresh token and store its replacement. Returns the id of the
+// user the token belongs to and the token's family, even when it was reused
+func (db *Database) rotateRefreshToken(hash, newHash string) (string, string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(context.Background())
+
+	var userId, familyId string
+	var expiresAt time.Time
+	var used, revoked bool
+	str := `
+		select UserID, FamilyID, ExpiresAt, UsedAt is not null, RevokedAt is not null
+		from RefreshTokens where Hash = $1 for update`
+	err = tx.QueryRow(context.Background(), str, hash).Scan(
+		&userId, &familyId, &expiresAt, &used, &revoked)
+	if err == pgx.ErrNoRows {
+		return "", "", ErrRefreshTokenInvalid
+	} else if err != nil {
+		return "", "", err
+	}
+
+	if revoked || time.Now().After(expiresAt) {
+		return "", "", ErrRefreshTokenInvalid
+	}
+
+	if used {
+		str = `
+			update RefreshTokens set RevokedAt = now()
+			where FamilyID = $1 and RevokedAt is null`
+		if _, err := tx.Exec(context.Background(), str, familyId); err != nil {
+			return "", "", err
+		}
+		if err := revokeSessions(tx, userId, familyId); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(context.Background()); err != nil {
+			return "", "", err
+		}
+		return userId, familyId, ErrRefreshTokenReused
+	}
+
+	str = "update RefreshTokens set UsedAt = now() where Hash = $1"
+	if _, err := tx.Exec(context.Background(), str, hash); err != nil {
+		return "", "", err
+	}
+
+	str = "update Sessions set LastSeenAt = now() where ID = $1"
+	if _, err := tx.Exec(context.Background(), str, familyId); err != nil {
+		return "", "", err
+	}
+
+	// The session slides forward every time the token is refreshed
+	str = `
+		insert into RefreshTokens (Hash, UserID, FamilyID, ExpiresAt)
+		values ($1, $2, $3, $4)`
+	_, err = tx.Exec(
+		context.Background(), str, newHash, userId, familyId,
+		time.Now().Add(refreshTokenLifetime),
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	return userId, familyId, tx.Commit(context.Background())
+}
+
+// Start a new session for the user, along with its access token and the
+// refresh token that starts its family. The session's id is the jti of
+// its first access token
+func (app *App) issueTokens(userId, userAgent, ip string) (TokenPair, error) {
+	sessionId := uuid.NewString()
+	token, err := createToken(app.keys, userId, sessionId, sessionId)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	if err := app.db.insertSession(sessionId, userId, userAgent, ip); err != nil {
+		return TokenPair{}, err
+	}
+
+	err = app.db.insertRefreshToken(userId, sessionId, hashToken(refreshToken))
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	pair := TokenPair{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+	}
+	return pair, nil
+}
+
+// Respond with the tokens of a new session for a user that proved who they
+// are. Users with two-factor authentication get a partial token instead,
+// which they exchange for tokens once they've entered their code
+func (app *App) logIn(ctx *gin.Context, userId string) {
+	enabled, err := app.db.totpEnabled(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if enabled {
+		token, err := createPartialToken(app.keys, userId)
+		if err != nil {
+			handleResponse(ctx, http.StatusInternalServerError, nil)
+			return
+		}
+		response := map[string]any{"twoFactorRequired": true, "partialToken": token}
+		handleResponse(ctx, http.StatusOK, response)
+		return
+	}
+
+	tokens, err := app.issueTokens(userId, ctx.Request.UserAgent(), ctx.ClientIP())
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+	handleResponse(ctx, http.StatusOK, tokens)
+}
+
+type RefreshData struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
+
+// Exchange a refresh token for a new access token and refresh token
+func (app *App) RefreshTokens(ctx *gin.Context) {
+	var data RefreshData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	userId, sessionId, err := app.db.rotateRefreshToken(
+		hashToken(data.RefreshToken), hashToken(refreshToken))
+	if err == ErrRefreshTokenReused {
+		log.Printf("refresh token reuse detected, revoked the token family")
+		app.sessions.set(sessionId, true)
+		handleResponse(ctx, http.StatusUnauthorized, err.Error())
+		return
+	} else if err == ErrRefreshTokenInvalid {
+		handleResponse(ctx, http.StatusUnauthorized, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	token, err := createToken(
+		app.keys, userId, sessionId, uuid.NewString())
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	pair := TokenPair{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenLifetime.Seconds()),
+	}
+	handleResponse(ctx, http.StatusOK, pair)
+}
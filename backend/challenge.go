@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Signing up can require solving a challenge first, which makes creating
+// accounts in bulk expensive. Clients get the challenge from /auth/challenge
+// and send their answer along with the signup. SIGNUP_CHALLENGE picks the
+// kind of challenge:
+//   - none (the default)
+//   - pow, a proof of work that's signed with POW_SECRET. Clients have to
+//     find a solution where sha256(token + ":" + solution) starts with
+//     POW_DIFFICULTY zero bits (20 by default)
+//   - captcha, checked by posting to CAPTCHA_VERIFY_URL with CAPTCHA_SECRET,
+//     which works with hCaptcha, Turnstile and reCAPTCHA. Clients show the
+//     captcha using CAPTCHA_SITE_KEY
+type SignupChallenge interface {
+	// Get what the client needs to know to answer the challenge
+	issue() (map[string]any, error)
+	verify(answer ChallengeAnswer, ip string) error
+}
+
+type ChallengeAnswer struct {
+	Token    string `json:"token"`
+	Solution string `json:"solution"`
+}
+
+var ErrChallengeFailed error = fmt.Errorf("challenge failed, try again")
+
+const (
+	defaultPowDifficulty = 20
+	maxPowDifficulty     = 32
+	powLifetime          = 5 * time.Minute
+)
+
+func loadSignupChallenge(secrets map[string]string, db Database) (SignupChallenge, error) {
+	switch kind := secrets["SIGNUP_CHALLENGE"]; kind {
+	case "", "none":
+		return noChallenge{}, nil
+
+	case "pow":
+		if len(secrets["POW_SECRET"]) < minSecretLength {
+			return nil, fmt.Errorf("POW_SECRET must be at least %d characters", minSecretLength)
+		}
+		difficulty := defaultPowDifficulty
+		if value := secrets["POW_DIFFICULTY"]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxPowDifficulty {
+				return nil, fmt.Errorf("POW_DIFFICULTY must be between 1 and %d", maxPowDifficulty)
+			}
+			difficulty = n
+		}
+		return proofOfWork{[]byte(secrets["POW_SECRET"]), difficulty, db}, nil
+
+	case "captcha":
+		c := captcha{
+			verifyURL: secrets["CAPTCHA_VERIFY_URL"],
+			secret:    secrets["CAPTCHA_SECRET"],
+			siteKey:   secrets["CAPTCHA_SITE_KEY"],
+		}
+		if c.verifyURL == "" || c.secret == "" || c.siteKey == "" {
+			return nil, fmt.Errorf("captcha challenges need CAPTCHA_VERIFY_URL, " +
+				"CAPTCHA_SECRET and CAPTCHA_SITE_KEY")
+		}
+		return c, nil
+
+	default:
+		return nil, fmt.Errorf("unknown signup challenge %q", kind)
+	}
+}
+
+type noChallenge struct{}
+
+func (noChallenge) issue() (map[string]any, error) {
+	return map[string]any{"type": "none"}, nil
+}
+
+func (noChallenge) verify(answer ChallengeAnswer, ip string) error { return nil }
+
+// Proof of work tokens hold everything needed to check them, signed so
+// clients can't pick easier ones. Solved tokens are remembered until they
+// expire, so each one can only be used for a single signup
+type proofOfWork struct {
+	secret     []byte
+	difficulty int
+	db         Database
+}
+
+func (p proofOfWork) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p proofOfWork) issue() (map[string]any, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(powLifetime).Unix()
+	payload := fmt.Sprintf(
+		"%s.%d.%d", base64.RawURLEncoding.EncodeToString(nonce), expiresAt, p.difficulty)
+	token := payload + "." + p.sign(payload)
+
+	response := map[string]any{
+		"type": "pow", "token": token, "difficulty": p.difficulty,
+	}
+	return response, nil
+}
+
+func leadingZeroBits(hash []byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+func (p proofOfWork) verify(answer ChallengeAnswer, ip string) error {
+	parts := strings.Split(answer.Token, ".")
+	if len(parts) != 4 {
+		return ErrChallengeFailed
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(p.sign(payload)), []byte(parts[3])) {
+		return ErrChallengeFailed
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return ErrChallengeFailed
+	}
+
+	// The difficulty is the one the token was issued with
+	difficulty, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return ErrChallengeFailed
+	}
+
+	hash := sha256.Sum256([]byte(answer.Token + ":" + answer.Solution))
+	if leadingZeroBits(hash[:]) < difficulty {
+		return ErrChallengeFailed
+	}
+
+	str := `
+		insert into UsedChallenges (Hash, ExpiresAt) values ($1, $2)
+		on conflict (Hash) do nothing`
+	result, err := p.db.pool.Exec(
+		context.Background(), str, hashToken(answer.Token), time.Unix(expiresAt, 0))
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+type captcha struct {
+	verifyURL string
+	secret    string
+	siteKey   string
+}
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+func (c captcha) issue() (map[string]any, error) {
+	return map[string]any{"type": "captcha", "siteKey": c.siteKey}, nil
+}
+
+func (c captcha) verify(answer ChallengeAnswer, ip string) error {
+	if answer.Token == "" {
+		return ErrChallengeFailed
+	}
+
+	form := url.Values{}
+	form.Set("secret", c.secret)
+	form.Set("response", answer.Token)
+	form.Set("remoteip", ip)
+
+	response, err := captchaClient.PostForm(c.verifyURL, form)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+func (app *App) GetSignupChallenge(ctx *gin.Context) {
+	challenge, err := app.challenge.issue()
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+	handleResponse(ctx, http.StatusOK, challenge)
+}
@@ -3,30 +3,75 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Card struct {
-	ID    int    `json:"id"`
-	Front string `json:"front"`
-	Back  string `json:"back"`
+	ID       int      `json:"id"`
+	Front    string   `json:"front"`
+	Back     string   `json:"back"`
+	Position int      `json:"position"`
+	Version  int      `json:"version,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
 }
 
+// Version is the version of the card the client edited. It's
+// ignored when it's 0, which is what older clients send
 type EditedCard struct {
 	ID      int    `json:"id"`
 	Front   string `json:"front"`
 	Back    string `json:"back"`
+	Version int    `json:"version"`
 	Edited  bool   `json:"edited"`
 	Created bool   `json:"created"`
 	Deleted bool   `json:"deleted"`
 }
 
 type Deck struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Cards []Card `json:"cards"`
+	ID int `json:"id"`
+	DeckMetadata
+	Version int    `json:"version,omitempty"`
+	Cards   []Card `json:"cards"`
+}
+
+// The cover asset is the id of one of the deck's assets
+type DeckMetadata struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Subject     string `json:"subject"`
+	Language    string `json:"language"`
+	CoverAsset  string `json:"coverAsset"`
+}
+
+// A partial edit of a deck's metadata, where null fields are left unchanged
+type MetadataEdit struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Subject     *string `json:"subject"`
+	Language    *string `json:"language"`
+	CoverAsset  *string `json:"coverAsset"`
+}
+
+// A deck without its cards
+type DeckSummary struct {
+	ID int `json:"id"`
+	DeckMetadata
+	FolderID  int       `json:"folderId"`
+	Tags      []string  `json:"tags"`
+	CardCount int       `json:"cardCount"`
+	DueCount  int       `json:"dueCount"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Only list decks with the tag and/or inside the folder (or its subfolders)
+type DeckFilter struct {
+	Tag      string
+	FolderID int
 }
 
 type Database struct{ pool *pgxpool.Pool }
@@ -54,6 +99,246 @@ func NewDatabase(url string) (Database, error) {
 			DeckID integer not null,
 			Front text not null,
 			Back text not null
+		);
+
+		alter table Decks add column if not exists Published boolean not null default false;
+		alter table Decks add column if not exists PublishedAt timestamptz;
+		alter table Decks add column if not exists Copies integer not null default 0;
+		alter table Decks add column if not exists Hidden boolean not null default false;
+		create table if not exists DeckFlags (
+			DeckID integer not null,
+			UserID text not null,
+			Reason text not null,
+			CreatedAt timestamptz not null default now(),
+			primary key (DeckID, UserID)
+		);
+		alter table Decks add column if not exists ReviewedAt timestamptz;
+		alter table Users add column if not exists Moderator boolean not null default false;
+		create index if not exists DecksNameSearch on Decks
+			using gin (to_tsvector('english', Name));
+		create index if not exists FlashcardsTextSearch on Flashcards
+			using gin (to_tsvector('english', Front || ' ' || Back));
+
+		alter table Decks add column if not exists UpdatedAt timestamptz not null default now();
+		create index if not exists DecksByUser on Decks (UserID, UpdatedAt desc, ID desc);
+		create index if not exists FlashcardsByDeck on Flashcards (DeckID, ID);
+
+		create table if not exists Folders (
+			ID serial not null primary key,
+			UserID text not null,
+			ParentID integer,
+			Name text not null
+		);
+		create unique index if not exists FoldersByName on Folders
+			(UserID, coalesce(ParentID, 0), Name);
+		alter table Decks add column if not exists FolderID integer;
+		create table if not exists Tags (
+			ID serial not null primary key,
+			UserID text not null,
+			Name text not null,
+			unique (UserID, Name)
+		);
+		create table if not exists DeckTags (
+			DeckID integer not null,
+			TagID integer not null,
+			primary key (DeckID, TagID)
+		);
+		create table if not exists CardTags (
+			CardID integer not null,
+			TagID integer not null,
+			primary key (CardID, TagID)
+		);
+
+		alter table Flashcards add column if not exists Position integer not null default 0;
+		drop index if exists FlashcardsByDeck;
+		create index if not exists FlashcardsByPosition on Flashcards (DeckID, Position, ID);
+
+		alter table Decks add column if not exists CreatedAt timestamptz not null default now();
+		alter table Decks add column if not exists Version integer not null default 1;
+		alter table Flashcards add column if not exists CreatedAt timestamptz not null default now();
+		alter table Flashcards add column if not exists UpdatedAt timestamptz not null default now();
+		alter table Flashcards add column if not exists Version integer not null default 1;
+
+		create table if not exists Tombstones (
+			UserID text not null,
+			DeckID integer not null,
+			CardID integer not null default 0,
+			DeletedAt timestamptz not null default now()
+		);
+		create index if not exists TombstonesByUser on Tombstones (UserID, DeletedAt);
+		create table if not exists SyncMutations (
+			UserID text not null,
+			ClientID text not null,
+			ServerID integer not null default 0,
+			Status text not null,
+			Reason text not null default '',
+			CreatedAt timestamptz not null default now(),
+			primary key (UserID, ClientID)
+		);
+
+		alter table Decks add column if not exists DeletedAt timestamptz;
+		alter table Flashcards add column if not exists DeletedAt timestamptz;
+
+		create table if not exists CardRevisions (
+			ID serial not null primary key,
+			CardID integer not null,
+			UserID text not null,
+			Action text not null,
+			FrontBefore text,
+			BackBefore text,
+			FrontAfter text,
+			BackAfter text,
+			CreatedAt timestamptz not null default now()
+		);
+		create index if not exists CardRevisionsByCard on CardRevisions (CardID, ID);
+
+		alter table Decks add column if not exists Description text not null default '';
+		alter table Decks add column if not exists Subject text not null default '';
+		alter table Decks add column if not exists Language text not null default '';
+		alter table Decks add column if not exists CoverAsset text not null default '';
+		create table if not exists Assets (
+			ID text not null primary key,
+			UserID text not null,
+			DeckID integer,
+			Mimetype text not null,
+			Data bytea not null,
+			CreatedAt timestamptz not null default now()
+		);
+
+		alter table Flashcards add column if not exists Due timestamptz not null default now();
+		alter table Flashcards add column if not exists Stability float8 not null default 0;
+		alter table Flashcards add column if not exists Difficulty float8 not null default 0;
+		alter table Flashcards add column if not exists Reps integer not null default 0;
+		alter table Flashcards add column if not exists Lapses integer not null default 0;
+		alter table Flashcards add column if not exists LastReview timestamptz;
+		alter table Flashcards add column if not exists ScheduledAt timestamptz not null default now();
+		create table if not exists Reviews (
+			ID serial primary key,
+			UserID text not null,
+			CardID integer not null,
+			Rating smallint not null,
+			ElapsedMs integer not null,
+			ReviewedAt timestamptz not null
+		);
+		create index if not exists ReviewsByUser on Reviews (UserID, ReviewedAt);
+		create index if not exists ReviewsByCard on Reviews (CardID, ReviewedAt);
+
+		create table if not exists StudySessions (
+			ID serial primary key,
+			UserID text not null,
+			CardIDs integer[] not null,
+			CreatedAt timestamptz not null default now(),
+			EndedAt timestamptz
+		);
+		alter table Reviews add column if not exists SessionID integer;
+		create index if not exists ReviewsBySession on Reviews (SessionID);
+
+		create table if not exists UserParameters (
+			UserID text not null primary key,
+			Parameters float8[],
+			Status text not null,
+			Loss float8,
+			BaselineLoss float8,
+			ReviewCount integer not null default 0,
+			UpdatedAt timestamptz not null default now(),
+			OptimizedAt timestamptz
+		);
+
+		create table if not exists CardExplanations (
+			CardID integer not null,
+			TextHash text not null,
+			Explanation text not null,
+			Hints text[] not null,
+			CreatedAt timestamptz not null default now(),
+			primary key (CardID, TextHash)
+		);
+
+		create table if not exists RefreshTokens (
+			Hash text not null primary key,
+			UserID text not null,
+			FamilyID text not null,
+			ExpiresAt timestamptz not null,
+			CreatedAt timestamptz not null default now(),
+			UsedAt timestamptz,
+			RevokedAt timestamptz
+		);
+		create index if not exists RefreshTokensByFamily on RefreshTokens (FamilyID);
+		create table if not exists Sessions (
+			ID text not null primary key,
+			UserID text not null,
+			UserAgent text not null,
+			IPAddress text not null,
+			CreatedAt timestamptz not null default now(),
+			LastSeenAt timestamptz not null default now(),
+			RevokedAt timestamptz
+		);
+		create index if not exists SessionsByUser on Sessions (UserID);
+		alter table Users add column if not exists VerifiedAt timestamptz;
+		create table if not exists EmailTokens (
+			Hash text not null primary key,
+			UserID text not null,
+			Purpose text not null,
+			ExpiresAt timestamptz not null,
+			CreatedAt timestamptz not null default now(),
+			UsedAt timestamptz
+		);
+		create index if not exists EmailTokensByUser on EmailTokens (UserID, Purpose);
+		alter table Users add column if not exists TOTPSecret text;
+		alter table Users add column if not exists TOTPEnabled boolean not null default false;
+		alter table Users add column if not exists TOTPLastStep bigint not null default 0;
+		create table if not exists RecoveryCodes (
+			UserID text not null,
+			Hash text not null,
+			UsedAt timestamptz,
+			primary key (UserID, Hash)
+		);
+		create table if not exists ExternalIdentities (
+			Provider text not null,
+			Subject text not null,
+			UserID text not null,
+			Email text not null,
+			CreatedAt timestamptz not null default now(),
+			LastLoginAt timestamptz not null default now(),
+			primary key (Provider, Subject)
+		);
+		create unique index if not exists ExternalIdentitiesByUser
+			on ExternalIdentities (UserID, Provider);
+		create unique index if not exists UsersByEmail on Users (lower(Email));
+		create table if not exists OIDCStates (
+			State text not null primary key,
+			Provider text not null,
+			Nonce text not null,
+			Verifier text not null,
+			LinkUserID text,
+			ExpiresAt timestamptz not null
+		);
+		create table if not exists LoginAttempts (
+			Key text not null primary key,
+			Failures integer not null,
+			LastFailureAt timestamptz not null,
+			LockedUntil timestamptz
+		);
+		create table if not exists UsedChallenges (
+			Hash text not null primary key,
+			ExpiresAt timestamptz not null
+		);
+		alter table Users add column if not exists Plan text not null default 'free';
+		create table if not exists UsageLedger (
+			ID serial primary key,
+			UserID text not null,
+			Action text not null,
+			PromptTokens integer not null,
+			CompletionTokens integer not null,
+			TotalTokens integer not null,
+			Images integer not null,
+			CreatedAt timestamptz not null default now()
+		);
+		create index if not exists UsageLedgerByUser on UsageLedger (UserID, CreatedAt);
+		create table if not exists RateLimitBuckets (
+			Key text not null primary key,
+			Tokens float8 not null,
+			Allowed boolean not null,
+			UpdatedAt timestamptz not null
 		);`
 	_, err = pool.Exec(context.Background(), statement)
 	if err != nil {
@@ -88,9 +373,10 @@ func (db *Database) userExists(userId string) (bool, error) {
 // then return the associated user id
 var ErrUserNotFound error = fmt.Errorf("user with email not found")
 var ErrWrongPassword error = fmt.Errorf("incorrect password")
+var ErrInvalidCredentials error = fmt.Errorf("incorrect email or password")
 
 func (db *Database) validateUserCredentials(email, password string) (string, error) {
-	str := "select ID, Password from Users where Email = $1"
+	str := "select ID, Password from Users where lower(Email) = lower($1)"
 	row := db.pool.QueryRow(context.Background(), str, email)
 
 	var userId, existingPassword string
@@ -108,6 +394,13 @@ func (db *Database) validateUserCredentials(email, password string) (string, err
 	return userId, nil
 }
 
+var ErrDeckNotFound error = fmt.Errorf("deck not found")
+var ErrCardNotFound error = fmt.Errorf("card not found")
+var ErrVersionConflict error = fmt.Errorf("deck was modified by another device")
+var ErrInvalidCoverAsset error = fmt.Errorf("cover isn't one of the deck's assets")
+
+// Move a deck to the trash. It stays there until it's
+// restored or until it gets purged by purgeTrash
 func (db *Database) deleteDeck(userId string, deckId int) error {
 	tx, err := db.pool.Begin(context.Background())
 	if err != nil {
@@ -115,13 +408,19 @@ func (db *Database) deleteDeck(userId string, deckId int) error {
 	}
 	defer tx.Rollback(context.Background())
 
-	str := "delete from Flashcards where DeckID = $1"
-	_, err = tx.Exec(context.Background(), str, deckId)
+	str := `
+		update Decks set DeletedAt = now(), UpdatedAt = now()
+		where UserID = $1 and ID = $2 and DeletedAt is null`
+	tag, err := tx.Exec(context.Background(), str, userId, deckId)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeckNotFound
+	}
 
-	str = "delete from Decks where UserID = $1 and ID = $2"
+	// A deck's tombstone has a card id of 0
+	str = "insert into Tombstones (UserID, DeckID) values ($1, $2)"
 	_, err = tx.Exec(context.Background(), str, userId, deckId)
 	if err != nil {
 		return err
@@ -130,7 +429,9 @@ func (db *Database) deleteDeck(userId string, deckId int) error {
 	return tx.Commit(context.Background())
 }
 
-func (db *Database) insertDeck(userId string, deck Deck) (int, error) {
+// Insert a deck along with its cards, and attach the
+// assets the cards were generated from to it
+func (db *Database) insertDeck(userId string, deck Deck, assetIds []string) (int, error) {
 	tx, err := db.pool.Begin(context.Background())
 	if err != nil {
 		return -1, err
@@ -144,54 +445,249 @@ func (db *Database) insertDeck(userId string, deck Deck) (int, error) {
 		return -1, err
 	}
 
-	for _, card := range deck.Cards {
-		str := "insert into Flashcards (DeckId, Front, Back) values ($1, $2, $3);"
-		_, err = tx.Exec(context.Background(), str, deckId, card.Front, card.Back)
+	for i, card := range deck.Cards {
+		str := `
+			insert into Flashcards (DeckId, Front, Back, Position)
+			values ($1, $2, $3, $4) returning ID;`
+		err = tx.QueryRow(
+			context.Background(), str, deckId, card.Front, card.Back, i,
+		).Scan(&card.ID)
+		if err != nil {
+			return -1, err
+		}
+
+		// Keep the llm's output around so it can be compared with later edits
+		err = recordRevision(tx, userId, card.ID, revisionGenerated, nil, &card)
 		if err != nil {
 			return -1, err
 		}
 	}
 
+	if err := attachAssets(tx, userId, deckId, assetIds); err != nil {
+		return -1, err
+	}
+
 	err = tx.Commit(context.Background())
 	return deckId, err
 }
 
-func (db *Database) updateDeck(userId string, id int, cards []EditedCard) ([]Card, error) {
+// Apply the metadata and card edits and reorder the cards. When the client
+// tells us which version of the deck or its cards it edited, and that version
+// is outdated, nothing is changed and ErrVersionConflict is returned instead
+func (db *Database) updateDeck(
+	userId string, id int, version *int,
+	metadata MetadataEdit, cards []EditedCard, order []int,
+) (Deck, error) {
 	tx, err := db.pool.Begin(context.Background())
 	if err != nil {
-		return nil, err
+		return Deck{}, err
 	}
 	defer tx.Rollback(context.Background())
 
+	var currentVersion int
+	str := `
+		select Version from Decks
+		where UserID = $1 and ID = $2 and DeletedAt is null for update`
+	err = tx.QueryRow(context.Background(), str, userId, id).Scan(&currentVersion)
+	if err == pgx.ErrNoRows {
+		return Deck{}, ErrDeckNotFound
+	} else if err != nil {
+		return Deck{}, err
+	}
+
+	if version != nil && *version != currentVersion {
+		return Deck{}, ErrVersionConflict
+	}
+
+	if err := updateDeckMetadata(tx, userId, id, metadata); err != nil {
+		return Deck{}, err
+	}
+
 	for _, card := range cards {
-		var err error
+		if card.Created {
+			if _, err := appendFlashcard(tx, userId, id, card.Front, card.Back); err != nil {
+				return Deck{}, err
+			}
+			continue
+		}
 
+		var changed bool
+		var err error
 		if card.Deleted {
-			str := "delete from Flashcards where DeckID = $1 and ID = $2;"
-			_, err = tx.Exec(context.Background(), str, id, card.ID)
-		} else if card.Created {
-			str := "insert into Flashcards (DeckId, Front, Back) values ($1, $2, $3);"
-			_, err = tx.Exec(context.Background(), str, id, card.Front, card.Back)
+			changed, err = deleteFlashcard(tx, userId, id, card.ID, card.Version)
 		} else {
-			str := "update Flashcards set Front = $3, Back = $4 where DeckID = $1 and ID = $2;"
-			_, err = tx.Exec(context.Background(), str, id, card.ID, card.Front, card.Back)
+			edited := Card{ID: card.ID, Front: card.Front, Back: card.Back, Version: card.Version}
+			changed, err = editFlashcard(tx, userId, id, edited, revisionEdited)
 		}
 
 		if err != nil {
-			return nil, err
+			return Deck{}, err
+		}
+
+		// The card was changed or deleted by someone else
+		if !changed && card.Version != 0 {
+			return Deck{}, ErrVersionConflict
 		}
 	}
 
+	if len(order) > 0 {
+		if err := reorderFlashcards(tx, id, order); err != nil {
+			return Deck{}, err
+		}
+	}
+
+	if err := bumpDeckVersion(tx, id); err != nil {
+		return Deck{}, err
+	}
+
 	err = tx.Commit(context.Background())
 	if err != nil {
-		return nil, err
+		return Deck{}, err
+	}
+
+	return db.getDeck(userId, id)
+}
+
+func updateDeckMetadata(tx pgx.Tx, userId string, deckId int, metadata MetadataEdit) error {
+	if metadata.CoverAsset != nil && *metadata.CoverAsset != "" {
+		var exists bool
+		str := `
+			select exists (
+				select 1 from Assets where UserID = $1 and DeckID = $2 and ID = $3
+			)`
+		err := tx.QueryRow(
+			context.Background(), str, userId, deckId, *metadata.CoverAsset,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrInvalidCoverAsset
+		}
 	}
 
-	return db.getFlashcards(id)
+	str := `
+		update Decks set
+			Name = coalesce($2, Name),
+			Description = coalesce($3, Description),
+			Subject = coalesce($4, Subject),
+			Language = coalesce($5, Language),
+			CoverAsset = coalesce($6, CoverAsset)
+		where ID = $1`
+	_, err := tx.Exec(
+		context.Background(), str, deckId, metadata.Name, metadata.Description,
+		metadata.Subject, metadata.Language, metadata.CoverAsset,
+	)
+	return err
+}
+
+// Add a new card to the end of a deck and return its id
+func appendFlashcard(tx pgx.Tx, userId string, deckId int, front, back string) (int, error) {
+	str := `
+		insert into Flashcards (DeckId, Front, Back, Position)
+		select $1, $2, $3, coalesce(max(Position) + 1, 0)
+		from Flashcards where DeckID = $1 and DeletedAt is null
+		returning ID;`
+	card := Card{Front: front, Back: back}
+	err := tx.QueryRow(context.Background(), str, deckId, front, back).Scan(&card.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordRevision(tx, userId, card.ID, revisionCreated, nil, &card)
+	return card.ID, err
+}
+
+// Change the text of a card if its version matches (or the version is 0)
+// and record the change in the card's history
+func editFlashcard(tx pgx.Tx, userId string, deckId int, card Card, action string) (bool, error) {
+	var before Card
+	str := `
+		select Front, Back from Flashcards
+		where DeckID = $1 and ID = $2 and DeletedAt is null
+		and ($3 = 0 or Version = $3) for update`
+	err := tx.QueryRow(context.Background(), str, deckId, card.ID, card.Version).Scan(
+		&before.Front, &before.Back)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if before.Front == card.Front && before.Back == card.Back {
+		return true, nil // Nothing to change
+	}
+
+	str = `
+		update Flashcards set Front = $2, Back = $3,
+			Version = Version + 1, UpdatedAt = now()
+		where ID = $1`
+	_, err = tx.Exec(context.Background(), str, card.ID, card.Front, card.Back)
+	if err != nil {
+		return false, err
+	}
+
+	err = recordRevision(tx, userId, card.ID, action, &before, &card)
+	return err == nil, err
+}
+
+// Move a card to the trash if its version matches (or the version is 0) and
+// leave a tombstone so other devices find out about it when syncing
+func deleteFlashcard(tx pgx.Tx, userId string, deckId, cardId, version int) (bool, error) {
+	str := `
+		update Flashcards set DeletedAt = now(), UpdatedAt = now()
+		where DeckID = $1 and ID = $2 and DeletedAt is null
+		and ($3 = 0 or Version = $3)
+		returning Front, Back;`
+	var before Card
+	err := tx.QueryRow(context.Background(), str, deckId, cardId, version).Scan(
+		&before.Front, &before.Back)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = recordRevision(tx, userId, cardId, revisionDeleted, &before, nil)
+	if err != nil {
+		return false, err
+	}
+
+	str = "insert into Tombstones (UserID, DeckID, CardID) values ($1, $2, $3)"
+	_, err = tx.Exec(context.Background(), str, userId, deckId, cardId)
+	return err == nil, err
+}
+
+func bumpDeckVersion(tx pgx.Tx, deckId int) error {
+	str := "update Decks set Version = Version + 1, UpdatedAt = now() where ID = $1"
+	_, err := tx.Exec(context.Background(), str, deckId)
+	return err
+}
+
+// Renumber the positions of the cards in a deck so that the cards in the order
+// list (a list of card ids) come first, followed by the rest of the cards
+func reorderFlashcards(tx pgx.Tx, deckId int, order []int) error {
+	str := `
+		update Flashcards f set Position = p.NewPosition, UpdatedAt = now()
+		from (
+			select c.ID, row_number() over (
+				order by o.Index nulls last, c.Position, c.ID
+			) - 1 as NewPosition
+			from Flashcards c
+			left join unnest($2::integer[]) with ordinality as o(CardID, Index)
+			on o.CardID = c.ID
+			where c.DeckID = $1 and c.DeletedAt is null
+		) p
+		where f.ID = p.ID and f.Position <> p.NewPosition`
+	_, err := tx.Exec(context.Background(), str, deckId, order)
+	return err
 }
 
 func (db *Database) getFlashcards(deckId int) ([]Card, error) {
-	str := "select ID, Front, Back from Flashcards where DeckID = $1"
+	str := `
+		select ID, Front, Back, Position, Version from Flashcards
+		where DeckID = $1 and DeletedAt is null
+		order by Position, ID`
 	rows, err := db.pool.Query(context.Background(), str, deckId)
 	if err != nil {
 		return nil, err
@@ -200,19 +696,42 @@ func (db *Database) getFlashcards(deckId int) ([]Card, error) {
 
 	cards := []Card{}
 	for rows.Next() {
-		var id int
-		var cardFront, cardBack string
-		if err := rows.Scan(&id, &cardFront, &cardBack); err != nil {
+		var card Card
+		err := rows.Scan(&card.ID, &card.Front, &card.Back, &card.Position, &card.Version)
+		if err != nil {
 			return nil, err
 		}
-		cards = append(cards, Card{ID: id, Front: cardFront, Back: cardBack})
+		cards = append(cards, card)
 	}
 
 	return cards, nil
 }
 
+// Get one of the user's cards along with the id of its deck
+func (db *Database) getCard(userId string, cardId int) (Card, int, error) {
+	var deckId int
+	card := Card{ID: cardId}
+	str := `
+		select f.DeckID, f.Front, f.Back, f.Position, f.Version
+		from Flashcards f join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and f.ID = $2
+		and d.DeletedAt is null and f.DeletedAt is null`
+	err := db.pool.QueryRow(context.Background(), str, userId, cardId).Scan(
+		&deckId, &card.Front, &card.Back, &card.Position, &card.Version)
+	if err == pgx.ErrNoRows {
+		return Card{}, 0, ErrCardNotFound
+	}
+	return card, deckId, err
+}
+
 func (db *Database) getDecks(userId string) ([]Deck, error) {
-	str := "select ID, Name from Decks where UserID = $1"
+	str := `
+		select d.ID, d.Name, d.Description, d.Subject, d.Language, d.CoverAsset, d.Version,
+			f.ID, f.Front, f.Back, f.Position, f.Version
+		from Decks d left join Flashcards f
+		on f.DeckID = d.ID and f.DeletedAt is null
+		where d.UserID = $1 and d.DeletedAt is null
+		order by d.ID, f.Position, f.ID`
 	rows, err := db.pool.Query(context.Background(), str, userId)
 	if err != nil {
 		return nil, err
@@ -221,19 +740,166 @@ func (db *Database) getDecks(userId string) ([]Deck, error) {
 
 	decks := []Deck{}
 	for rows.Next() {
-		var deckId int
-		var deckName string
-		if err := rows.Scan(&deckId, &deckName); err != nil {
+		var deckId, deckVersion int
+		var m DeckMetadata
+		var cardId, cardPosition, cardVersion *int
+		var cardFront, cardBack *string
+		err := rows.Scan(
+			&deckId, &m.Name, &m.Description, &m.Subject, &m.Language, &m.CoverAsset,
+			&deckVersion, &cardId, &cardFront, &cardBack, &cardPosition, &cardVersion,
+		)
+		if err != nil {
 			return nil, err
 		}
 
-		cards, err := db.getFlashcards(deckId)
+		if len(decks) == 0 || decks[len(decks)-1].ID != deckId {
+			deck := Deck{ID: deckId, DeckMetadata: m, Version: deckVersion, Cards: []Card{}}
+			decks = append(decks, deck)
+		}
+
+		if cardId != nil { // Decks without cards have a single row of nulls
+			deck := &decks[len(decks)-1]
+			card := Card{
+				ID: *cardId, Front: *cardFront, Back: *cardBack,
+				Position: *cardPosition, Version: *cardVersion,
+			}
+			deck.Cards = append(deck.Cards, card)
+		}
+	}
+
+	return decks, rows.Err()
+}
+
+func (db *Database) getDeck(userId string, deckId int) (Deck, error) {
+	deck := Deck{ID: deckId}
+	str := `
+		select Name, Description, Subject, Language, CoverAsset, Version from Decks
+		where UserID = $1 and ID = $2 and DeletedAt is null`
+	err := db.pool.QueryRow(context.Background(), str, userId, deckId).Scan(
+		&deck.Name, &deck.Description, &deck.Subject, &deck.Language,
+		&deck.CoverAsset, &deck.Version,
+	)
+	if err == pgx.ErrNoRows {
+		return Deck{}, ErrDeckNotFound
+	} else if err != nil {
+		return Deck{}, err
+	}
+
+	deck.Cards, err = db.getFlashcards(deckId)
+	return deck, err
+}
+
+func (db *Database) deckExists(userId string, deckId int) (bool, error) {
+	str := `
+		select exists (
+			select 1 from Decks
+			where UserID = $1 and ID = $2 and DeletedAt is null
+		)`
+	var exists bool
+	err := db.pool.QueryRow(context.Background(), str, userId, deckId).Scan(&exists)
+	return exists, err
+}
+
+// Get a page of the user's deck summaries, most recently updated first.
+// The page starts after the deck pointed to by the cursor, if there is one
+func (db *Database) getDeckSummaries(
+	userId string, filter DeckFilter, after *DeckSummary, limit int,
+) ([]DeckSummary, error) {
+	var afterTime *time.Time
+	afterId := 0
+	if after != nil {
+		afterTime, afterId = &after.UpdatedAt, after.ID
+	}
+
+	str := `
+		select d.ID, d.Name, d.Description, d.Subject, d.Language, d.CoverAsset,
+			coalesce(d.FolderID, 0), d.Version, d.CreatedAt, d.UpdatedAt,
+			coalesce((
+				select array_agg(t.Name order by t.Name)
+				from DeckTags dt join Tags t on t.ID = dt.TagID
+				where dt.DeckID = d.ID
+			), '{}'),
+			count(f.ID), count(f.ID) filter (where f.Due <= now())
+		from Decks d left join Flashcards f
+		on f.DeckID = d.ID and f.DeletedAt is null
+		where d.UserID = $1 and d.DeletedAt is null
+		and ($2::timestamptz is null or (d.UpdatedAt, d.ID) < ($2::timestamptz, $3::integer))
+		and ($5::text = '' or exists (
+			select 1 from DeckTags dt join Tags t on t.ID = dt.TagID
+			where dt.DeckID = d.ID and t.Name = $5
+		))
+		and ($6::integer = 0 or d.FolderID in (
+			with recursive subtree as (
+				select ID from Folders where UserID = $1 and ID = $6
+				union all
+				select c.ID from Folders c join subtree on c.ParentID = subtree.ID
+			)
+			select ID from subtree
+		))
+		group by d.ID
+		order by d.UpdatedAt desc, d.ID desc
+		limit $4`
+	rows, err := db.pool.Query(
+		context.Background(), str, userId, afterTime, afterId, limit,
+		filter.Tag, filter.FolderID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decks := []DeckSummary{}
+	for rows.Next() {
+		var d DeckSummary
+		err := rows.Scan(
+			&d.ID, &d.Name, &d.Description, &d.Subject, &d.Language, &d.CoverAsset,
+			&d.FolderID, &d.Version, &d.CreatedAt, &d.UpdatedAt,
+			&d.Tags, &d.CardCount, &d.DueCount,
+		)
 		if err != nil {
 			return nil, err
 		}
+		decks = append(decks, d)
+	}
+
+	return decks, rows.Err()
+}
+
+// Get a page of the cards in a deck, starting after the card pointed to by the cursor
+func (db *Database) getFlashcardsPage(deckId int, after *Card, limit int) ([]Card, error) {
+	afterPosition, afterId := -1, 0
+	if after != nil {
+		afterPosition, afterId = after.Position, after.ID
+	}
 
-		decks = append(decks, Deck{ID: deckId, Name: deckName, Cards: cards})
+	str := `
+		select f.ID, f.Front, f.Back, f.Position, f.Version, coalesce((
+			select array_agg(t.Name order by t.Name)
+			from CardTags ct join Tags t on t.ID = ct.TagID
+			where ct.CardID = f.ID
+		), '{}')
+		from Flashcards f
+		where f.DeckID = $1 and f.DeletedAt is null
+		and (f.Position, f.ID) > ($2::integer, $3::integer)
+		order by f.Position, f.ID
+		limit $4`
+	rows, err := db.pool.Query(
+		context.Background(), str, deckId, afterPosition, afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []Card{}
+	for rows.Next() {
+		var card Card
+		err := rows.Scan(
+			&card.ID, &card.Front, &card.Back, &card.Position, &card.Version, &card.Tags)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
 	}
 
-	return decks, nil
+	return cards, rows.Err()
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Emailed tokens prove the user owns their email address. Like refresh
+// tokens they're random strings that are only stored hashed, and each
+// one can only be used once. Links to the app's verification and password
+// reset pages hold the token, which the pages then send back to the api
+const (
+	verifyEmailPurpose   = "verify"
+	resetPasswordPurpose = "reset"
+
+	verificationTokenLifetime = 24 * time.Hour
+	resetTokenLifetime        = time.Hour
+	// Users have to wait this long before being emailed another token
+	emailTokenCooldown = time.Minute
+
+	minPasswordLength = 8
+)
+
+var ErrEmailTokenInvalid error = fmt.Errorf("invalid or expired link")
+var ErrEmailTokenCooldown error = fmt.Errorf("an email was sent recently, try again later")
+var ErrAlreadyVerified error = fmt.Errorf("email is already verified")
+var ErrPasswordTooShort error = fmt.Errorf(
+	"password must be at least %d characters", minPasswordLength)
+
+// Store a new token for the user, unless one
+// with the same purpose was created recently
+func (db *Database) insertEmailToken(userId, purpose, hash string, lifetime time.Duration) error {
+	var recent bool
+	str := `
+		select exists (
+			select 1 from EmailTokens
+			where UserID = $1 and Purpose = $2 and CreatedAt > $3
+		)`
+	cutoff := time.Now().Add(-emailTokenCooldown)
+	err := db.pool.QueryRow(context.Background(), str, userId, purpose, cutoff).Scan(&recent)
+	if err != nil {
+		return err
+	}
+	if recent {
+		return ErrEmailTokenCooldown
+	}
+
+	str = `
+		insert into EmailTokens (Hash, UserID, Purpose, ExpiresAt)
+		values ($1, $2, $3, $4)`
+	_, err = db.pool.Exec(
+		context.Background(), str, hash, userId, purpose, time.Now().Add(lifetime))
+	return err
+}
+
+// Use up a token and return the id of the user it belongs to. The user's
+// other tokens with the same purpose are used up along with it
+func useEmailToken(tx pgx.Tx, hash, purpose string) (string, error) {
+	var userId string
+	str := `
+		select UserID from EmailTokens
+		where Hash = $1 and Purpose = $2 and UsedAt is null and ExpiresAt > now()
+		for update`
+	err := tx.QueryRow(context.Background(), str, hash, purpose).Scan(&userId)
+	if err == pgx.ErrNoRows {
+		return "", ErrEmailTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+
+	str = `
+		update EmailTokens set UsedAt = now()
+		where UserID = $1 and Purpose = $2 and UsedAt is null`
+	_, err = tx.Exec(context.Background(), str, userId, purpose)
+	return userId, err
+}
+
+func (db *Database) getUserEmail(userId string) (string, bool, error) {
+	var email string
+	var verified bool
+	str := "select Email, VerifiedAt is not null from Users where ID = $1"
+	err := db.pool.QueryRow(context.Background(), str, userId).Scan(&email, &verified)
+	if err == pgx.ErrNoRows {
+		return "", false, ErrUserNotFound
+	}
+	return email, verified, err
+}
+
+func (db *Database) getUserByEmail(email string) (string, error) {
+	var userId string
+	str := "select ID from Users where lower(Email) = lower($1)"
+	err := db.pool.QueryRow(context.Background(), str, email).Scan(&userId)
+	if err == pgx.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return userId, err
+}
+
+func (db *Database) verifyEmail(hash string) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	userId, err := useEmailToken(tx, hash, verifyEmailPurpose)
+	if err != nil {
+		return err
+	}
+
+	str := "update Users set VerifiedAt = coalesce(VerifiedAt, now()) where ID = $1"
+	if _, err := tx.Exec(context.Background(), str, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Set the user's new password and log them out everywhere, returning the
+// ids of the sessions that were revoked. Resetting the password proves
+// the user owns their email, so it gets verified along the way
+func (db *Database) resetPassword(hash, password string) ([]string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	userId, err := useEmailToken(tx, hash, resetPasswordPurpose)
+	if err != nil {
+		return nil, err
+	}
+
+	str := `
+		update Users set Password = $2, VerifiedAt = coalesce(VerifiedAt, now())
+		where ID = $1`
+	if _, err := tx.Exec(context.Background(), str, userId, password); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	str = `
+		select coalesce(array_agg(ID), '{}') from Sessions
+		where UserID = $1 and RevokedAt is null`
+	if err := tx.QueryRow(context.Background(), str, userId).Scan(&ids); err != nil {
+		return nil, err
+	}
+
+	if err := revokeSessions(tx, userId, ""); err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit(context.Background())
+}
+
+// Used tokens are kept until they expire, so that they're still rejected
+func (db *Database) pruneEmailTokens() error {
+	str := "delete from EmailTokens where ExpiresAt < now()"
+	_, err := db.pool.Exec(context.Background(), str)
+	return err
+}
+
+// Build a link to one of the app's pages that holds the token
+func (app *App) emailLink(page, token string) string {
+	base := strings.TrimRight(app.secrets["APP_URL"], "/")
+	return fmt.Sprintf("%s/%s?token=%s", base, page, url.QueryEscape(token))
+}
+
+func (app *App) sendVerificationEmail(userId, email string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	err = app.db.insertEmailToken(
+		userId, verifyEmailPurpose, hashToken(token), verificationTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	link := app.emailLink("verify", token)
+	return app.emailUser(
+		email, "Verify your Snapcram email", "templates/verify.template", link)
+}
+
+func (app *App) sendResetEmail(userId, email string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	err = app.db.insertEmailToken(
+		userId, resetPasswordPurpose, hashToken(token), resetTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	link := app.emailLink("reset-password", token)
+	return app.emailUser(
+		email, "Reset your Snapcram password", "templates/reset.template", link)
+}
+
+type EmailTokenData struct {
+	Token string `json:"token" binding:"required"`
+}
+
+func (app *App) VerifyEmail(ctx *gin.Context) {
+	var data EmailTokenData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	err := app.db.verifyEmail(hashToken(data.Token))
+	if err == ErrEmailTokenInvalid {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, map[string]any{"verified": true})
+}
+
+// Email the user another verification link
+func (app *App) ResendVerification(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	email, verified, err := app.db.getUserEmail(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if verified {
+		handleResponse(ctx, http.StatusBadRequest, ErrAlreadyVerified.Error())
+		return
+	}
+
+	err = app.sendVerificationEmail(userId, email)
+	if err == ErrEmailTokenCooldown {
+		handleResponse(ctx, http.StatusTooManyRequests, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+type ResetRequestData struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// Email a password reset link to the user. The response is the same whether
+// or not the account exists, so it can't be used to find out who has one.
+// Sending the email is slow, so it's sent after responding, which keeps the
+// response time from giving the account away too
+func (app *App) RequestPasswordReset(ctx *gin.Context) {
+	var data ResetRequestData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	userId, err := app.db.getUserByEmail(data.Email)
+	if err == ErrUserNotFound {
+		handleResponse(ctx, http.StatusOK, nil)
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	go func() {
+		err := app.sendResetEmail(userId, data.Email)
+		if err != nil && err != ErrEmailTokenCooldown {
+			log.Printf("sending a password reset email failed: %v", err)
+		}
+	}()
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+type ResetPasswordData struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func (app *App) ResetPassword(ctx *gin.Context) {
+	var data ResetPasswordData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if len(data.Password) < minPasswordLength {
+		handleResponse(ctx, http.StatusBadRequest, ErrPasswordTooShort.Error())
+		return
+	}
+
+	ids, err := app.db.resetPassword(hashToken(data.Token), data.Password)
+	if err == ErrEmailTokenInvalid {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	for _, id := range ids {
+		app.sessions.set(id, true)
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Explanations are cached by the text of the card they explain,
+// so editing a card makes the next request generate a new one
+type Explanation struct {
+	Explanation string    `json:"explanation"`
+	Hints       []string  `json:"hints"`
+	Cached      bool      `json:"cached"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+const (
+	hintCount = 3
+	// At most this many of the deck's images are sent along with the card
+	maxExplanationImages = 2
+)
+
+func cardTextHash(card Card) string {
+	hash := sha256.Sum256([]byte(card.Front + "\x00" + card.Back))
+	return hex.EncodeToString(hash[:])
+}
+
+func (db *Database) getExplanation(cardId int, hash string) (Explanation, error) {
+	explanation := Explanation{Cached: true}
+	str := `
+		select Explanation, Hints, CreatedAt from CardExplanations
+		where CardID = $1 and TextHash = $2`
+	err := db.pool.QueryRow(context.Background(), str, cardId, hash).Scan(
+		&explanation.Explanation, &explanation.Hints, &explanation.CreatedAt)
+	return explanation, err
+}
+
+func (db *Database) insertExplanation(cardId int, hash string, explanation Explanation) error {
+	// Explanations of the card's old text are useless now
+	str := `
+		with removed as (
+			delete from CardExplanations where CardID = $1 and TextHash <> $2
+		)
+		insert into CardExplanations (CardID, TextHash, Explanation, Hints, CreatedAt)
+		values ($1, $2, $3, $4, $5)
+		on conflict (CardID, TextHash) do nothing`
+	_, err := db.pool.Exec(
+		context.Background(), str, cardId, hash,
+		explanation.Explanation, explanation.Hints, explanation.CreatedAt,
+	)
+	return err
+}
+
+// Get the images the deck was generated from
+func (db *Database) getDeckImages(deckId, limit int) ([]Asset, error) {
+	str := `
+		select ID, Mimetype, Data from Assets
+		where DeckID = $1 and Mimetype like 'image/%'
+		order by CreatedAt, ID limit $2`
+	rows, err := db.pool.Query(context.Background(), str, deckId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []Asset{}
+	for rows.Next() {
+		var asset Asset
+		if err := rows.Scan(&asset.ID, &asset.Mimetype, &asset.Data); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+
+	return assets, rows.Err()
+}
+
+// Respond with an explanation of the card's answer and hints for it,
+// which are ordered from vaguest to most specific
+func (app *App) ExplainCard(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	cardId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	card, deckId, err := app.db.getCard(userId, cardId)
+	if err == ErrCardNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	hash := cardTextHash(card)
+	explanation, err := app.db.getExplanation(cardId, hash)
+	if err == nil {
+		handleResponse(ctx, http.StatusOK, explanation)
+		return
+	} else if err != pgx.ErrNoRows {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	images, err := app.db.getDeckImages(deckId, maxExplanationImages)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if !app.checkQuota(ctx, userId, len(images)) {
+		return
+	}
+
+	explanation, usage, err := explainCard(
+		app.secrets["GROQ_API_KEY"], userId, card, images)
+	app.recordUsage(userId, usageExplain, usage)
+	if err != nil {
+		log.Printf("explaining card %d failed: %v", cardId, err)
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if explanation.Hints == nil {
+		explanation.Hints = []string{}
+	}
+	explanation.CreatedAt = time.Now()
+
+	if err := app.db.insertExplanation(cardId, hash, explanation); err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, explanation)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Folders form a tree per user. A folder's path is the names
+// of its ancestors and itself joined by slashes (ex. "Biology/Cell").
+// A parent id of 0 refers to the root of the tree
+type Folder struct {
+	ID       int    `json:"id"`
+	ParentID int    `json:"parentId"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+const maxFolderDepth = 8
+
+var ErrFolderNotFound error = fmt.Errorf("folder not found")
+var ErrFolderExists error = fmt.Errorf("folder already exists")
+var ErrFolderCycle error = fmt.Errorf("folder can't be moved inside itself")
+var ErrFolderTooDeep error = fmt.Errorf("folder path is too deep")
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func validFolderName(name string) bool {
+	return len(name) > 0 && len(name) <= 64 && !strings.Contains(name, "/")
+}
+
+// Map 0 to null so that it can be stored in the nullable ParentID column
+func nullableID(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+func (db *Database) getFolders(userId string) ([]Folder, error) {
+	str := `
+		with recursive tree as (
+			select ID, ParentID, Name, Name as Path from Folders
+			where UserID = $1 and ParentID is null
+			union all
+			select f.ID, f.ParentID, f.Name, tree.Path || '/' || f.Name
+			from Folders f join tree on f.ParentID = tree.ID
+		)
+		select ID, coalesce(ParentID, 0), Name, Path from tree order by Path`
+	rows, err := db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []Folder{}
+	for rows.Next() {
+		var f Folder
+		if err := rows.Scan(&f.ID, &f.ParentID, &f.Name, &f.Path); err != nil {
+			return nil, err
+		}
+		folders = append(folders, f)
+	}
+
+	return folders, rows.Err()
+}
+
+// Create every missing folder along the path and return the last one
+func (db *Database) createFolderPath(userId string, names []string) (Folder, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return Folder{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	folder := Folder{Path: strings.Join(names, "/")}
+	for _, name := range names {
+		str := `
+			insert into Folders (UserID, ParentID, Name) values ($1, $2, $3)
+			on conflict (UserID, coalesce(ParentID, 0), Name)
+			do update set Name = excluded.Name
+			returning ID`
+		parentId := folder.ID
+		err := tx.QueryRow(
+			context.Background(), str, userId, nullableID(parentId), name,
+		).Scan(&folder.ID)
+		if err != nil {
+			return Folder{}, err
+		}
+		folder.ParentID, folder.Name = parentId, name
+	}
+
+	return folder, tx.Commit(context.Background())
+}
+
+func (db *Database) folderExists(userId string, folderId int) (bool, error) {
+	str := "select exists (select 1 from Folders where UserID = $1 and ID = $2)"
+	var exists bool
+	err := db.pool.QueryRow(context.Background(), str, userId, folderId).Scan(&exists)
+	return exists, err
+}
+
+// Get the ids of a folder and all of its descendants, along with
+// how many levels deep the subtree goes (1 for a folder without subfolders)
+func getFolderSubtree(tx pgx.Tx, userId string, folderId int) ([]int, int, error) {
+	str := `
+		with recursive subtree as (
+			select ID, 1 as Level from Folders where UserID = $1 and ID = $2
+			union all
+			select f.ID, subtree.Level + 1
+			from Folders f join subtree on f.ParentID = subtree.ID
+		)
+		select array_agg(ID), coalesce(max(Level), 0) from subtree`
+	var ids []int
+	var height int
+	err := tx.QueryRow(context.Background(), str, userId, folderId).Scan(&ids, &height)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(ids) == 0 {
+		return nil, 0, ErrFolderNotFound
+	}
+	return ids, height, nil
+}
+
+// Get how many folders deep a folder is, counting itself
+func getFolderDepth(tx pgx.Tx, userId string, folderId int) (int, error) {
+	str := `
+		with recursive ancestors as (
+			select ID, ParentID from Folders where UserID = $1 and ID = $2
+			union all
+			select f.ID, f.ParentID
+			from Folders f join ancestors on f.ID = ancestors.ParentID
+		)
+		select count(*) from ancestors`
+	var depth int
+	err := tx.QueryRow(context.Background(), str, userId, folderId).Scan(&depth)
+	if err != nil {
+		return 0, err
+	}
+	if depth == 0 {
+		return 0, ErrFolderNotFound
+	}
+	return depth, nil
+}
+
+// Rename a folder and/or move it under a different parent. Either change
+// is optional, and both are applied together or not at all
+func (db *Database) editFolder(userId string, folderId int, name *string, parentId *int) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	subtree, height, err := getFolderSubtree(tx, userId, folderId)
+	if err != nil {
+		return err
+	}
+
+	if name != nil {
+		str := "update Folders set Name = $3 where UserID = $1 and ID = $2"
+		_, err := tx.Exec(context.Background(), str, userId, folderId, *name)
+		if isUniqueViolation(err) {
+			return ErrFolderExists
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if parentId != nil {
+		for _, id := range subtree {
+			if id == *parentId {
+				return ErrFolderCycle
+			}
+		}
+
+		parentDepth := 0
+		if *parentId != 0 {
+			parentDepth, err = getFolderDepth(tx, userId, *parentId)
+			if err != nil {
+				return err
+			}
+		}
+		if parentDepth+height > maxFolderDepth {
+			return ErrFolderTooDeep
+		}
+
+		str := "update Folders set ParentID = $3 where UserID = $1 and ID = $2"
+		_, err := tx.Exec(context.Background(), str, userId, folderId, nullableID(*parentId))
+		if isUniqueViolation(err) {
+			return ErrFolderExists
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Delete a folder and its subfolders. The decks inside
+// them get moved to the root instead of getting deleted
+func (db *Database) deleteFolder(userId string, folderId int) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	subtree, _, err := getFolderSubtree(tx, userId, folderId)
+	if err != nil {
+		return err
+	}
+
+	str := "update Decks set FolderID = null where UserID = $1 and FolderID = any($2)"
+	_, err = tx.Exec(context.Background(), str, userId, subtree)
+	if err != nil {
+		return err
+	}
+
+	str = "delete from Folders where UserID = $1 and ID = any($2)"
+	_, err = tx.Exec(context.Background(), str, userId, subtree)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (db *Database) setDeckFolder(userId string, deckId, folderId int) error {
+	if folderId != 0 {
+		exists, err := db.folderExists(userId, folderId)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrFolderNotFound
+		}
+	}
+
+	str := `
+		update Decks set FolderID = $3, UpdatedAt = now()
+		where UserID = $1 and ID = $2 and DeletedAt is null`
+	tag, err := db.pool.Exec(
+		context.Background(), str, userId, deckId, nullableID(folderId))
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeckNotFound
+	}
+	return nil
+}
+
+// Respond with an error message for the errors
+// the folder operations are expected to return
+func handleFolderError(ctx *gin.Context, err error) {
+	switch err {
+	case ErrFolderNotFound, ErrDeckNotFound:
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+	case ErrFolderExists, ErrFolderCycle, ErrFolderTooDeep:
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+	default:
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+	}
+}
+
+func (app *App) GetFolders(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	folders, err := app.db.getFolders(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"folders": folders}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+type CreateFolderData struct {
+	Path string `json:"path" binding:"required"`
+}
+
+func (app *App) CreateFolder(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data CreateFolderData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	names := strings.Split(strings.Trim(data.Path, "/ "), "/")
+	if len(names) > maxFolderDepth {
+		handleResponse(ctx, http.StatusBadRequest, ErrFolderTooDeep.Error())
+		return
+	}
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+		if !validFolderName(names[i]) {
+			handleResponse(ctx, http.StatusBadRequest, "invalid folder name")
+			return
+		}
+	}
+
+	folder, err := app.db.createFolderPath(userId, names)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, folder)
+}
+
+type EditFolderData struct {
+	Name     *string `json:"name"`
+	ParentID *int    `json:"parentId"`
+}
+
+// Rename a folder and/or move it under a different parent
+func (app *App) EditFolder(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	folderId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data EditFolderData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if data.Name != nil {
+		name := strings.TrimSpace(*data.Name)
+		if !validFolderName(name) {
+			handleResponse(ctx, http.StatusBadRequest, "invalid folder name")
+			return
+		}
+		data.Name = &name
+	}
+
+	err = app.db.editFolder(userId, folderId, data.Name, data.ParentID)
+	if err != nil {
+		handleFolderError(ctx, err)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+func (app *App) DeleteFolder(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	folderId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if err := app.db.deleteFolder(userId, folderId); err != nil {
+		handleFolderError(ctx, err)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+type DeckFolderData struct {
+	FolderID *int `json:"folderId" binding:"required"`
+}
+
+// Move a deck into a folder, or to the root when the folder id is 0
+func (app *App) SetDeckFolder(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data DeckFolderData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if err := app.db.setDeckFolder(userId, deckId, *data.FolderID); err != nil {
+		handleFolderError(ctx, err)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Spaced repetition scheduling using the FSRS algorithm (version 4.5), adapted
+// from fsrs4anki. A card's memory is modeled with its stability (the number of
+// days until the odds of recalling it drop to 90%) and its difficulty (1 to
+// 10). Each review updates both, and the card is scheduled for when the odds
+// of recalling it drop to the desired retention
+
+const (
+	ratingAgain = 1
+	ratingHard  = 2
+	ratingGood  = 3
+	ratingEasy  = 4
+)
+
+const (
+	fsrsDecay  = -0.5
+	fsrsFactor = 19.0 / 81.0
+
+	desiredRetention = 0.9
+	maxIntervalDays  = 36500
+	minStability     = 0.01
+)
+
+// The 17 model weights
+type FSRSParameters []float64
+
+var defaultParameters = FSRSParameters{
+	0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031,
+	1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755,
+}
+
+type Memory struct {
+	Stability  float64
+	Difficulty float64
+}
+
+type ReviewEvent struct {
+	Rating     int
+	ReviewedAt time.Time
+}
+
+// A card's scheduling state after replaying its reviews
+type Schedule struct {
+	Stability  float64    `json:"stability"`
+	Difficulty float64    `json:"difficulty"`
+	Reps       int        `json:"reps"`
+	Lapses     int        `json:"lapses"`
+	LastReview *time.Time `json:"lastReview"`
+	Due        time.Time  `json:"due"`
+}
+
+// The odds of recalling a card some days after it was last reviewed
+func retrievability(elapsedDays, stability float64) float64 {
+	return math.Pow(1+fsrsFactor*elapsedDays/stability, fsrsDecay)
+}
+
+// The number of days until the odds of recalling a card drop to the retention
+func intervalDays(stability, retention float64) float64 {
+	interval := stability / fsrsFactor * (math.Pow(retention, 1/fsrsDecay) - 1)
+	return min(interval, maxIntervalDays)
+}
+
+func clampDifficulty(d float64) float64 { return min(max(d, 1), 10) }
+
+func (w FSRSParameters) initialDifficulty(rating int) float64 {
+	return w[4] - float64(rating-3)*w[5]
+}
+
+func (w FSRSParameters) initialMemory(rating int) Memory {
+	return Memory{
+		Stability:  max(w[rating-1], minStability),
+		Difficulty: clampDifficulty(w.initialDifficulty(rating)),
+	}
+}
+
+// Update the memory of a card after reviewing it
+func (w FSRSParameters) nextMemory(m Memory, elapsedDays float64, rating int) Memory {
+	r := retrievability(elapsedDays, m.Stability)
+
+	// The difficulty moves towards the difficulty of a card rated good
+	d := m.Difficulty - w[6]*float64(rating-3)
+	d = clampDifficulty(w[7]*w.initialDifficulty(ratingGood) + (1-w[7])*d)
+
+	var s float64
+	if rating == ratingAgain {
+		s = w[11] * math.Pow(m.Difficulty, -w[12]) *
+			(math.Pow(m.Stability+1, w[13]) - 1) * math.Exp(w[14]*(1-r))
+		s = min(s, m.Stability)
+	} else {
+		hardPenalty, easyBonus := 1.0, 1.0
+		if rating == ratingHard {
+			hardPenalty = w[15]
+		} else if rating == ratingEasy {
+			easyBonus = w[16]
+		}
+
+		growth := math.Exp(w[8]) * (11 - m.Difficulty) * math.Pow(m.Stability, -w[9]) *
+			(math.Exp(w[10]*(1-r)) - 1) * hardPenalty * easyBonus
+		s = m.Stability * (growth + 1)
+	}
+
+	return Memory{Stability: max(s, minStability), Difficulty: d}
+}
+
+// Replay a card's reviews (sorted oldest first) to compute its schedule.
+// Cards that have never been reviewed are due as soon as they're created
+func (w FSRSParameters) schedule(reviews []ReviewEvent, created time.Time) Schedule {
+	if len(reviews) == 0 {
+		return Schedule{Due: created}
+	}
+
+	var m Memory
+	schedule := Schedule{}
+	for i, review := range reviews {
+		if i == 0 {
+			m = w.initialMemory(review.Rating)
+		} else {
+			elapsed := review.ReviewedAt.Sub(reviews[i-1].ReviewedAt).Hours() / 24
+			m = w.nextMemory(m, max(elapsed, 0), review.Rating)
+		}
+
+		if review.Rating == ratingAgain && i > 0 {
+			schedule.Lapses++
+		}
+	}
+
+	last := reviews[len(reviews)-1].ReviewedAt
+	interval := intervalDays(m.Stability, desiredRetention)
+	due := last.Add(max(time.Duration(interval*24*float64(time.Hour)), 10*time.Minute))
+
+	schedule.Stability, schedule.Difficulty = m.Stability, m.Difficulty
+	schedule.Reps = len(reviews)
+	schedule.LastReview = &last
+	schedule.Due = due
+	return schedule
+}
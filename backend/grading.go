@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Typed answers are graded by comparing them to the back of the card.
+// Both are normalized first, so that case, punctuation and leading
+// articles don't matter, and small typos are forgiven by fuzzy matching.
+// Long free-form answers can optionally be graded by the llm instead
+
+const (
+	gradeExact = "exact"
+	gradeFuzzy = "fuzzy"
+	gradeLLM   = "llm"
+)
+
+const (
+	// Scores from 0 to 1 needed for an answer to be right or partially right
+	correctScore = 0.85
+	partialScore = 0.6
+	// Exact answers typed faster than this are rated easy
+	easyAnswerMs = 8000
+	// Answers with more words than this are considered free-form
+	freeFormWords   = 4
+	maxAnswerLength = 2000
+)
+
+type Grade struct {
+	Score    float64 `json:"score"`
+	Correct  bool    `json:"correct"`
+	Method   string  `json:"method"`
+	Feedback string  `json:"feedback,omitempty"`
+	Expected string  `json:"expected"`
+}
+
+func normalizeAnswer(answer string) string {
+	answer = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, answer)
+
+	words := strings.Fields(answer)
+	if len(words) > 1 && (words[0] == "a" || words[0] == "an" || words[0] == "the") {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// The number of single character edits needed to turn one string into the other
+func levenshtein(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	previous := make([]int, len(y)+1)
+	current := make([]int, len(y)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(x); i++ {
+		current[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(y)]
+}
+
+func similarity(a, b string) float64 {
+	length := max(len([]rune(a)), len([]rune(b)))
+	if length == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(length)
+}
+
+// The back of a card can list several acceptable answers,
+// separated by semicolons or on separate lines
+func acceptableAnswers(back string) []string {
+	answers := []string{normalizeAnswer(back)}
+	for _, part := range strings.FieldsFunc(back, func(r rune) bool {
+		return r == ';' || r == '\n'
+	}) {
+		if answer := normalizeAnswer(part); answer != "" {
+			answers = append(answers, answer)
+		}
+	}
+	return answers
+}
+
+func fuzzyGrade(back, answer string) Grade {
+	grade := Grade{Method: gradeFuzzy, Expected: back}
+	answer = normalizeAnswer(answer)
+	if answer == "" {
+		return grade
+	}
+
+	for _, expected := range acceptableAnswers(back) {
+		if answer == expected {
+			grade.Score, grade.Method = 1, gradeExact
+			break
+		}
+		grade.Score = max(grade.Score, similarity(answer, expected))
+	}
+
+	grade.Correct = grade.Score >= correctScore
+	return grade
+}
+
+func isFreeForm(back string) bool {
+	return len(strings.Fields(normalizeAnswer(back))) > freeFormWords
+}
+
+// Convert a grade into the rating the user would've given themselves
+func gradeRating(grade Grade, elapsedMs int) int {
+	if grade.Method == gradeExact && elapsedMs > 0 && elapsedMs < easyAnswerMs {
+		return ratingEasy
+	} else if grade.Score >= correctScore {
+		return ratingGood
+	} else if grade.Score >= partialScore {
+		return ratingHard
+	}
+	return ratingAgain
+}
+
+type AnswerData struct {
+	CardID    int    `json:"cardId" binding:"required"`
+	Answer    string `json:"answer"`
+	ElapsedMs int    `json:"elapsedMs" binding:"min=0"`
+	SessionID int    `json:"sessionId"`
+	// Let the llm grade free-form answers that fuzzy matching marks as wrong
+	UseLLM bool `json:"llm"`
+}
+
+// Grade a typed answer to a card and record it as a review
+func (app *App) AnswerCard(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data AnswerData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if len(data.Answer) > maxAnswerLength {
+		handleResponse(ctx, http.StatusBadRequest, "answer is too long")
+		return
+	}
+
+	card, _, err := app.db.getCard(userId, data.CardID)
+	if err == ErrCardNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	grade := fuzzyGrade(card.Back, data.Answer)
+	useLLM := data.UseLLM && !grade.Correct && isFreeForm(card.Back) &&
+		normalizeAnswer(data.Answer) != ""
+	if useLLM {
+		// Users that are out of quota just get the fuzzy grade
+		summary, err := app.getUsage(userId)
+		if err != nil {
+			handleResponse(ctx, http.StatusInternalServerError, nil)
+			return
+		}
+		_, exceeded := summary.exceeded(0)
+		useLLM = !exceeded
+	}
+
+	if useLLM {
+		// The fuzzy grade is still better than nothing when the llm fails
+		score, feedback, usage, err := gradeAnswer(
+			app.secrets["GROQ_API_KEY"], userId, card, data.Answer)
+		app.recordUsage(userId, usageGrade, usage)
+		if err != nil {
+			log.Printf("grading an answer to card %d failed: %v", card.ID, err)
+		} else {
+			grade.Score, grade.Method, grade.Feedback = score, gradeLLM, feedback
+			grade.Correct = score >= correctScore
+		}
+	}
+
+	rating := gradeRating(grade, data.ElapsedMs)
+	schedule, err := app.db.reviewCard(
+		userId, card.ID, data.SessionID, rating, data.ElapsedMs, time.Now())
+	if err == ErrCardNotFound || err == ErrSessionNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err == ErrSessionEnded {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"grade": grade, "rating": rating, "schedule": schedule}
+	handleResponse(ctx, http.StatusOK, response)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNormalizeAnswer(t *testing.T) {
+	tests := []struct{ answer, expected string }{
+		{"", ""},
+		{"   ", ""},
+		{"?!.", ""},
+		{"Mitochondria", "mitochondria"},
+		{"  The  Mitochondria! ", "mitochondria"},
+		{"an apple", "apple"},
+		{"A", "a"}, // a lone article is the answer itself
+		{"the", "the"},
+		{"theory", "theory"},
+		{"H2O, (water)", "h2o water"},
+		{"Ångström", "ångström"},
+		{"ΣΊΣΥΦΟΣ", "σίσυφοσ"},
+		{"東京", "東京"},
+		{"café-au-lait", "café au lait"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeAnswer(test.answer); got != test.expected {
+			t.Errorf("normalizeAnswer(%q) = %q, expected %q", test.answer, got, test.expected)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abc", "abc", 0},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"abc", "acb", 2},
+		// Unicode characters count as single edits
+		{"café", "cafe", 1},
+		{"東京", "京都", 2},
+		{"naïve", "naive", 1},
+	}
+
+	for _, test := range tests {
+		if got := levenshtein(test.a, test.b); got != test.distance {
+			t.Errorf("levenshtein(%q, %q) = %d, expected %d", test.a, test.b, got, test.distance)
+		}
+		if got := levenshtein(test.b, test.a); got != test.distance {
+			t.Errorf("levenshtein(%q, %q) = %d, expected %d", test.b, test.a, got, test.distance)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		score float64
+	}{
+		{"", "", 1},
+		{"", "abc", 0},
+		{"abcd", "abcd", 1},
+		{"abcd", "abce", 0.75},
+		{"東京", "東都", 0.5},
+	}
+
+	for _, test := range tests {
+		if got := similarity(test.a, test.b); math.Abs(got-test.score) > 1e-9 {
+			t.Errorf("similarity(%q, %q) = %f, expected %f", test.a, test.b, got, test.score)
+		}
+	}
+}
+
+func TestFuzzyGrade(t *testing.T) {
+	tests := []struct {
+		back, answer string
+		method       string
+		correct      bool
+	}{
+		{"Mitochondria", "mitochondria", gradeExact, true},
+		{"Mitochondria", "The mitochondria.", gradeExact, true},
+		{"Mitochondria", "mitocondria", gradeFuzzy, true},
+		{"Mitochondria", "ribosome", gradeFuzzy, false},
+		{"Mitochondria", "", gradeFuzzy, false},
+		{"Mitochondria", "?!", gradeFuzzy, false},
+		{"", "anything", gradeFuzzy, false},
+		{"", "", gradeFuzzy, false},
+		{"Paris; Lutetia", "lutetia", gradeExact, true},
+		{"Paris\nLutetia", "paris", gradeExact, true},
+		{"Paris; Lutetia", "Paris; Lutetia", gradeExact, true},
+		{"Ångström", "angstrom", gradeFuzzy, false},
+		{"Ångström", "ÅNGSTRÖM", gradeExact, true},
+		{"東京", "東京", gradeExact, true},
+		{"東京", "京都", gradeFuzzy, false},
+	}
+
+	for _, test := range tests {
+		grade := fuzzyGrade(test.back, test.answer)
+		if grade.Method != test.method || grade.Correct != test.correct {
+			t.Errorf("fuzzyGrade(%q, %q) = %s (correct: %t), expected %s (correct: %t)",
+				test.back, test.answer, grade.Method, grade.Correct, test.method, test.correct)
+		}
+		if grade.Score < 0 || grade.Score > 1 {
+			t.Errorf("fuzzyGrade(%q, %q) scored %f", test.back, test.answer, grade.Score)
+		}
+		if grade.Expected != test.back {
+			t.Errorf("fuzzyGrade(%q, %q) expected %q", test.back, test.answer, grade.Expected)
+		}
+	}
+}
+
+func TestGradeRating(t *testing.T) {
+	tests := []struct {
+		grade     Grade
+		elapsedMs int
+		rating    int
+	}{
+		{Grade{Score: 1, Method: gradeExact}, 2000, ratingEasy},
+		{Grade{Score: 1, Method: gradeExact}, 0, ratingGood},
+		{Grade{Score: 1, Method: gradeExact}, easyAnswerMs, ratingGood},
+		{Grade{Score: 0.9, Method: gradeFuzzy}, 2000, ratingGood},
+		{Grade{Score: 0.7, Method: gradeFuzzy}, 2000, ratingHard},
+		{Grade{Score: 0.2, Method: gradeFuzzy}, 2000, ratingAgain},
+		{Grade{Score: 0, Method: gradeFuzzy}, 0, ratingAgain},
+	}
+
+	for _, test := range tests {
+		if got := gradeRating(test.grade, test.elapsedMs); got != test.rating {
+			t.Errorf("gradeRating(%+v, %d) = %d, expected %d",
+				test.grade, test.elapsedMs, got, test.rating)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// An account at an identity provider that's linked to one of our users.
+// Signing in through the provider logs into the linked user
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// A sign in attempt that's waiting for the user to come back from the
+// provider. LinkUserID is set when a logged in user is linking an identity
+type OIDCState struct {
+	Nonce      string
+	Verifier   string
+	LinkUserID *string
+	ExpiresAt  time.Time
+}
+
+var ErrOIDCStateInvalid error = fmt.Errorf("sign in attempt expired, try again")
+var ErrIdentityLinked error = fmt.Errorf("this account is linked to another user")
+var ErrIdentityEmailTaken error = fmt.Errorf(
+	"an account with this email already exists, log in to link it")
+var ErrIdentityNoEmail error = fmt.Errorf("the identity provider didn't share an email")
+var ErrIdentityEmailUnverified error = fmt.Errorf(
+	"the identity provider hasn't verified your email")
+var ErrIdentityNotFound error = fmt.Errorf("identity not found")
+var ErrProviderLinked error = fmt.Errorf("an account from this provider is already linked")
+
+func (db *Database) insertOIDCState(state, provider string, s OIDCState) error {
+	str := `
+		insert into OIDCStates (State, Provider, Nonce, Verifier, LinkUserID, ExpiresAt)
+		values ($1, $2, $3, $4, $5, $6)`
+	_, err := db.pool.Exec(
+		context.Background(), str, hashToken(state), provider,
+		s.Nonce, s.Verifier, s.LinkUserID, s.ExpiresAt,
+	)
+	return err
+}
+
+// States can only be used once, so they're deleted as they're read
+func (db *Database) takeOIDCState(state, provider string) (OIDCState, error) {
+	var s OIDCState
+	str := `
+		delete from OIDCStates where State = $1 and Provider = $2
+		returning Nonce, Verifier, LinkUserID, ExpiresAt`
+	err := db.pool.QueryRow(context.Background(), str, hashToken(state), provider).Scan(
+		&s.Nonce, &s.Verifier, &s.LinkUserID, &s.ExpiresAt)
+	if err == pgx.ErrNoRows || (err == nil && time.Now().After(s.ExpiresAt)) {
+		return OIDCState{}, ErrOIDCStateInvalid
+	}
+	return s, err
+}
+
+func (db *Database) pruneOIDCStates() error {
+	str := "delete from OIDCStates where ExpiresAt < now()"
+	_, err := db.pool.Exec(context.Background(), str)
+	return err
+}
+
+func insertIdentity(tx pgx.Tx, provider, userId string, claims *IDTokenClaims) error {
+	str := `
+		insert into ExternalIdentities (Provider, Subject, UserID, Email)
+		values ($1, $2, $3, $4)`
+	_, err := tx.Exec(
+		context.Background(), str, provider, claims.Subject, userId, claims.Email)
+	return err
+}
+
+// Get the user the identity belongs to, linking it to a user when it's new.
+// New identities are linked to the user that's linking them, or to the user
+// with the same email when both the provider and we verified it. Otherwise
+// a new user is created for the identity, as long as the provider verified
+// its email. Creating users for unverified emails would let anyone claim
+// an email before its owner signs up, and keep access to the account
+// after the owner takes it back by resetting the password
+func (db *Database) resolveIdentity(
+	provider string, claims *IDTokenClaims, linkUserId *string) (string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(context.Background())
+
+	var userId string
+	str := `
+		select UserID from ExternalIdentities
+		where Provider = $1 and Subject = $2 for update`
+	err = tx.QueryRow(context.Background(), str, provider, claims.Subject).Scan(&userId)
+	if err != nil && err != pgx.ErrNoRows {
+		return "", err
+	}
+
+	if err == nil {
+		if linkUserId != nil && *linkUserId != userId {
+			return "", ErrIdentityLinked
+		}
+		str = `
+			update ExternalIdentities set Email = $3, LastLoginAt = now()
+			where Provider = $1 and Subject = $2`
+		_, err := tx.Exec(context.Background(), str, provider, claims.Subject, claims.Email)
+		if err != nil {
+			return "", err
+		}
+		return userId, tx.Commit(context.Background())
+	}
+
+	if linkUserId != nil {
+		userId = *linkUserId
+
+		var linked bool
+		str = `
+			select exists (
+				select 1 from ExternalIdentities where UserID = $1 and Provider = $2
+			)`
+		err := tx.QueryRow(context.Background(), str, userId, provider).Scan(&linked)
+		if err != nil {
+			return "", err
+		}
+		if linked {
+			return "", ErrProviderLinked
+		}
+	} else {
+		if claims.Email == "" {
+			return "", ErrIdentityNoEmail
+		}
+		if !claims.EmailVerified {
+			return "", ErrIdentityEmailUnverified
+		}
+
+		var verified bool
+		str = `
+			select ID, VerifiedAt is not null from Users
+			where lower(Email) = lower($1)`
+		err := tx.QueryRow(context.Background(), str, claims.Email).Scan(&userId, &verified)
+		if err == nil && !verified {
+			return "", ErrIdentityEmailTaken
+		} else if err == pgx.ErrNoRows {
+			// The user signs in through the provider, so their
+			// password is random until they reset it
+			password, err := generateToken()
+			if err != nil {
+				return "", err
+			}
+
+			userId = uuid.NewString()
+			str = `
+				insert into Users (ID, Email, Password, VerifiedAt)
+				values ($1, $2, $3, now())`
+			_, err = tx.Exec(context.Background(), str, userId, claims.Email, password)
+			if isUniqueViolation(err) {
+				// Someone else signed up with the email in the meantime
+				return "", ErrIdentityEmailTaken
+			} else if err != nil {
+				return "", err
+			}
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	if err := insertIdentity(tx, provider, userId, claims); err != nil {
+		if isUniqueViolation(err) {
+			return "", ErrIdentityLinked
+		}
+		return "", err
+	}
+	return userId, tx.Commit(context.Background())
+}
+
+func (db *Database) getIdentities(userId string) ([]Identity, error) {
+	str := `
+		select Provider, Email, CreatedAt from ExternalIdentities
+		where UserID = $1 order by CreatedAt`
+	rows, err := db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(&identity.Provider, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+func (db *Database) deleteIdentity(userId, provider string) error {
+	str := "delete from ExternalIdentities where UserID = $1 and Provider = $2"
+	result, err := db.pool.Exec(context.Background(), str, userId, provider)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
+
+func (app *App) GetOIDCProviders(ctx *gin.Context) {
+	providers := []map[string]string{}
+	for _, id := range slices.Sorted(maps.Keys(app.providers)) {
+		provider := app.providers[id]
+		providers = append(providers, map[string]string{
+			"id": provider.ID, "name": provider.Name,
+		})
+	}
+	handleResponse(ctx, http.StatusOK, map[string]any{"providers": providers})
+}
+
+// Respond with the url of the provider's sign in page. When the
+// request is authenticated, the identity is linked to the user instead
+func (app *App) StartOIDC(ctx *gin.Context) {
+	provider, ok := app.providers[ctx.Param("provider")]
+	if !ok {
+		handleResponse(ctx, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+
+	state := OIDCState{ExpiresAt: time.Now().Add(oidcStateLifetime)}
+	if ctx.GetHeader("Authorization") != "" {
+		userId, err := app.getUserID(ctx)
+		if err != nil {
+			handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+			return
+		}
+		state.LinkUserID = &userId
+	}
+
+	values := make([]string, 3)
+	for i := range values {
+		value, err := generateToken()
+		if err != nil {
+			handleResponse(ctx, http.StatusInternalServerError, nil)
+			return
+		}
+		values[i] = value
+	}
+	stateToken := values[0]
+	state.Nonce, state.Verifier = values[1], values[2]
+
+	authorizationURL, err := provider.authorizationURL(stateToken, state.Nonce, state.Verifier)
+	if err != nil {
+		log.Printf("discovering %s failed: %v", provider.ID, err)
+		handleResponse(ctx, http.StatusBadGateway, ErrOIDCProvider.Error())
+		return
+	}
+
+	err = app.db.insertOIDCState(stateToken, provider.ID, state)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"url": authorizationURL, "state": stateToken}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+type OIDCCallbackData struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+// Finish signing in with the code and state the provider redirected the
+// user back with. Responds with our own tokens, like a password login
+func (app *App) FinishOIDC(ctx *gin.Context) {
+	provider, ok := app.providers[ctx.Param("provider")]
+	if !ok {
+		handleResponse(ctx, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+
+	var data OIDCCallbackData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	state, err := app.db.takeOIDCState(data.State, provider.ID)
+	if err == ErrOIDCStateInvalid {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	idToken, err := provider.exchangeCode(data.Code, state.Verifier)
+	if err != nil {
+		log.Printf("exchanging a code with %s failed: %v", provider.ID, err)
+		handleResponse(ctx, http.StatusBadGateway, ErrOIDCProvider.Error())
+		return
+	}
+
+	claims, err := provider.validateIDToken(idToken, state.Nonce)
+	if errors.Is(err, ErrIDTokenInvalid) {
+		log.Printf("rejected an id token from %s: %v", provider.ID, err)
+		handleResponse(ctx, http.StatusUnauthorized, ErrIDTokenInvalid.Error())
+		return
+	} else if err != nil {
+		log.Printf("validating an id token from %s failed: %v", provider.ID, err)
+		handleResponse(ctx, http.StatusBadGateway, ErrOIDCProvider.Error())
+		return
+	}
+
+	userId, err := app.db.resolveIdentity(provider.ID, claims, state.LinkUserID)
+	if err == ErrIdentityLinked || err == ErrIdentityEmailTaken || err == ErrProviderLinked {
+		handleResponse(ctx, http.StatusConflict, err.Error())
+		return
+	} else if err == ErrIdentityNoEmail || err == ErrIdentityEmailUnverified {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if state.LinkUserID != nil {
+		response := map[string]any{"linked": true, "provider": provider.ID}
+		handleResponse(ctx, http.StatusOK, response)
+		return
+	}
+	app.logIn(ctx, userId)
+}
+
+func (app *App) GetIdentities(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	identities, err := app.db.getIdentities(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, map[string]any{"identities": identities})
+}
+
+func (app *App) UnlinkIdentity(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	err = app.db.deleteIdentity(userId, ctx.Param("provider"))
+	if err == ErrIdentityNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
@@ -7,35 +7,91 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func createToken(secret []byte, userId string) (string, error) {
-	expiry := time.Now().Add(time.Hour * 24 * 100).Unix() // Expires in 100 days
-	claims := jwt.MapClaims{"sub": userId, "exp": expiry}
+const (
+	tokenIssuer = "snapcram"
+	// The audience of access tokens, which are the only tokens the api accepts
+	accessAudience = "snapcram-api"
+	// Access tokens are short lived, clients use their refresh token to get new ones
+	accessTokenLifetime = 15 * time.Minute
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	encoded, err := token.SignedString(secret)
+	// Partial tokens are given to users that entered their password but still
+	// need to enter their second factor. They can only be exchanged for tokens
+	partialAudience      = "snapcram-2fa"
+	partialTokenLifetime = 5 * time.Minute
+)
+
+// Every access token belongs to a session, which is started when the user
+// logs in and can be revoked. The session's id is the jti of the first token,
+// and refreshed tokens keep it in sid while getting their own jti
+type TokenClaims struct {
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+func createToken(keys *Keyset, userId, sessionId, tokenId string) (string, error) {
+	now := time.Now()
+	claims := TokenClaims{
+		SessionID: sessionId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   userId,
+			Audience:  jwt.ClaimStrings{accessAudience},
+			ID:        tokenId,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenLifetime)),
+		},
+	}
+
+	return keys.sign(claims)
+}
+
+func createPartialToken(keys *Keyset, userId string) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Subject:   userId,
+		Audience:  jwt.ClaimStrings{partialAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(partialTokenLifetime)),
+	}
+	return keys.sign(claims)
+}
+
+func parseToken(encodedToken string, keys *Keyset) (*jwt.Token, error) {
+	return parseTokenFor(encodedToken, keys, accessAudience)
+}
+
+// Get the id of the user a partial token was given to
+func parsePartialToken(encodedToken string, keys *Keyset) (string, error) {
+	token, err := parseTokenFor(encodedToken, keys, partialAudience)
 	if err != nil {
 		return "", err
 	}
-	return encoded, nil
+
+	userId := token.Claims.(*TokenClaims).Subject
+	if userId == "" {
+		return "", fmt.Errorf("invalid token")
+	}
+	return userId, nil
 }
 
-func parseToken(encodedToken string, secret []byte) (*jwt.Token, error) {
+func parseTokenFor(encodedToken string, keys *Keyset, audience string) (*jwt.Token, error) {
 	token, err := jwt.ParseWithClaims(
 		encodedToken,
-		jwt.MapClaims{},
-		func(token *jwt.Token) (any, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return secret, nil
-		},
+		&TokenClaims{},
+		keys.verificationKey,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if _, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+	if _, ok := token.Claims.(*TokenClaims); ok && token.Valid {
 		return token, nil // valid token
 	}
 	return nil, fmt.Errorf("invalid token")
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens are signed with one key out of a keyset, and the key's id is put in
+// the token's kid header. Keys are rotated by adding a new key, signing with
+// it, and removing the old key once the tokens it signed have expired.
+//
+// The keyset is configured through the environment:
+//   - JWT_KEYS lists the ids of the keys, separated by commas
+//   - JWT_SIGNING_KEY is the id of the key used for signing,
+//     which defaults to the last key listed
+//   - JWT_KEY_<ID> holds each key as "<algorithm>:<key>", where the id is
+//     uppercased and dashes are replaced with underscores. The algorithm is
+//     HS256, RS256 or EdDSA. HS256 keys are the secret itself, while the
+//     others are PEM or base64 encoded DER keys. Keys that are only used to
+//     verify tokens can be public keys
+//
+// When JWT_KEYS isn't set, JWT_SECRET is used as the only key, with the id
+// "default". Tokens without a kid are verified with the default key, so
+// rotating away from JWT_SECRET starts by listing it as the default key
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// The private key is nil for keys that can only verify tokens
+	Private any
+	Public  any
+}
+
+type Keyset struct {
+	signing *SigningKey
+	keys    map[string]*SigningKey
+	ids     []string
+}
+
+// The id of the key built from JWT_SECRET, which
+// is also used for tokens that don't have a kid
+const legacyKeyID = "default"
+
+const minSecretLength = 32
+
+func decodeKeyMaterial(material string) ([]byte, error) {
+	if block, _ := pem.Decode([]byte(material)); block != nil {
+		return block.Bytes, nil
+	}
+
+	der, err := base64.StdEncoding.DecodeString(material)
+	if err != nil {
+		return nil, fmt.Errorf("key isn't PEM or base64 encoded")
+	}
+	if block, _ := pem.Decode(der); block != nil {
+		return block.Bytes, nil
+	}
+	return der, nil
+}
+
+func parseSigningKey(id, value string) (*SigningKey, error) {
+	algorithm, material, found := strings.Cut(value, ":")
+	if !found {
+		return nil, fmt.Errorf("key %s should be formatted as <algorithm>:<key>", id)
+	}
+
+	key := &SigningKey{ID: id}
+	if algorithm == "HS256" {
+		if len(material) < minSecretLength {
+			return nil, fmt.Errorf("key %s is too short", id)
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.Private, key.Public = []byte(material), []byte(material)
+		return key, nil
+	}
+
+	der, err := decodeKeyMaterial(material)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+
+	var parsed any
+	if private, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		parsed = private
+	} else if private, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		parsed = private
+	} else if public, err := x509.ParsePKIXPublicKey(der); err == nil {
+		parsed = public
+	} else {
+		return nil, fmt.Errorf("key %s can't be parsed", id)
+	}
+
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Private, key.Public = k, k.Public()
+	case ed25519.PublicKey:
+		key.Public = k
+	case *rsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Public = k
+	default:
+		return nil, fmt.Errorf("key %s has an unsupported type", id)
+	}
+
+	_, isEd25519 := key.Public.(ed25519.PublicKey)
+	_, isRSA := key.Public.(*rsa.PublicKey)
+	if algorithm == "EdDSA" && isEd25519 {
+		key.Method = jwt.SigningMethodEdDSA
+	} else if algorithm == "RS256" && isRSA {
+		key.Method = jwt.SigningMethodRS256
+	} else {
+		return nil, fmt.Errorf("key %s doesn't match the %s algorithm", id, algorithm)
+	}
+	return key, nil
+}
+
+func loadKeyset(secrets map[string]string) (*Keyset, error) {
+	keyset := &Keyset{keys: map[string]*SigningKey{}}
+
+	ids := []string{}
+	for _, id := range strings.Split(secrets["JWT_KEYS"], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		secret := secrets["JWT_SECRET"]
+		if secret == "" {
+			return nil, fmt.Errorf("neither JWT_KEYS nor JWT_SECRET are set")
+		}
+		key := &SigningKey{
+			ID: legacyKeyID, Method: jwt.SigningMethodHS256,
+			Private: []byte(secret), Public: []byte(secret),
+		}
+		keyset.keys[key.ID], keyset.signing = key, key
+		keyset.ids = []string{key.ID}
+		return keyset, nil
+	}
+
+	for _, id := range ids {
+		name := "JWT_KEY_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+		key, err := parseSigningKey(id, secrets[name])
+		if err != nil {
+			return nil, err
+		}
+		keyset.keys[id] = key
+	}
+	keyset.ids = ids
+
+	signingId := secrets["JWT_SIGNING_KEY"]
+	if signingId == "" {
+		signingId = ids[len(ids)-1]
+	}
+
+	keyset.signing = keyset.keys[signingId]
+	if keyset.signing == nil || keyset.signing.Private == nil {
+		return nil, fmt.Errorf("signing key %s isn't a private key in the keyset", signingId)
+	}
+	return keyset, nil
+}
+
+func (k *Keyset) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	token.Header["kid"] = k.signing.ID
+	return token.SignedString(k.signing.Private)
+}
+
+// Find the key a token was signed with. The token's algorithm must be
+// the key's algorithm, otherwise a public key could be used as an HMAC secret
+func (k *Keyset) verificationKey(token *jwt.Token) (any, error) {
+	id, ok := token.Header["kid"].(string)
+	if !ok {
+		id = legacyKeyID
+	}
+
+	key := k.keys[id]
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key: %v", id)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
+}
+
+func base64URLInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// Get the public keys as a JSON web key set. HMAC
+// keys are secret, so they're never included
+func (k *Keyset) jwks() []map[string]string {
+	keys := []map[string]string{}
+	for _, id := range k.ids {
+		key := k.keys[id]
+		jwk := map[string]string{"kid": key.ID, "use": "sig", "alg": key.Method.Alg()}
+		switch public := key.Public.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"], jwk["crv"] = "OKP", "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64URLInt(public.N)
+			jwk["e"] = base64URLInt(big.NewInt(int64(public.E)))
+		default:
+			continue
+		}
+		keys = append(keys, jwk)
+	}
+	return keys
+}
+
+func (app *App) GetJWKS(ctx *gin.Context) {
+	response := map[string]any{"keys": app.keys.jwks()}
+	handleResponse(ctx, http.StatusOK, response)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A deck that has been published to the public library
+type LibraryDeck struct {
+	ID int `json:"id"`
+	DeckMetadata
+	CardCount   int       `json:"cardCount"`
+	Copies      int       `json:"copies"`
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+// Published decks with at least this many flags get hidden from the library
+// until a moderator reviews them. Only flags made since the deck was last
+// reviewed count, so decks moderators kept up can't be taken down by the
+// same flags again. Moderators are users with Users.Moderator set
+const flagThreshold = 3
+
+// A published deck that was flagged since it was last reviewed
+type FlaggedDeck struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Hidden  bool     `json:"hidden"`
+	Flags   int      `json:"flags"`
+	Reasons []string `json:"reasons"`
+}
+
+var ErrNotModerator error = fmt.Errorf("only moderators can do this")
+
+var flagReasons = []string{"spam", "inappropriate", "copyright", "inaccurate", "other"}
+
+var librarySortOrders = map[string]string{
+	"relevance": "NameRank desc, MatchingCards desc, d.Copies desc, d.ID desc",
+	"popular":   "d.Copies desc, d.PublishedAt desc, d.ID desc",
+	"recent":    "d.PublishedAt desc, d.ID desc",
+}
+
+func (db *Database) publishDeck(userId string, deckId int, published bool) error {
+	str := `
+		update Decks set Published = $3,
+			PublishedAt = case when $3 then now() else null end
+		where UserID = $1 and ID = $2 and DeletedAt is null`
+	tag, err := db.pool.Exec(context.Background(), str, userId, deckId, published)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeckNotFound
+	}
+	return nil
+}
+
+// Search the published decks by matching the query against the
+// deck names and the text of their cards
+func (db *Database) searchLibrary(
+	query, sort string, limit, offset int,
+) ([]LibraryDeck, error) {
+	str := fmt.Sprintf(`
+		with search as (select websearch_to_tsquery('english', $1::text) as query)
+		select d.ID, d.Name, d.Description, d.Subject, d.Language, d.CoverAsset,
+			d.Copies, d.PublishedAt,
+			(select count(*) from Flashcards f
+				where f.DeckID = d.ID and f.DeletedAt is null
+			) as CardCount,
+			ts_rank(to_tsvector('english', d.Name), search.query) as NameRank,
+			(select count(*) from Flashcards f
+				where f.DeckID = d.ID and f.DeletedAt is null
+				and to_tsvector('english', f.Front || ' ' || f.Back) @@ search.query
+			) as MatchingCards
+		from Decks d, search
+		where d.Published and not d.Hidden and d.DeletedAt is null and (
+			$1::text = ''
+			or to_tsvector('english', d.Name) @@ search.query
+			or exists (
+				select 1 from Flashcards f
+				where f.DeckID = d.ID and f.DeletedAt is null
+				and to_tsvector('english', f.Front || ' ' || f.Back) @@ search.query
+			)
+		)
+		order by %s
+		limit $2 offset $3`, librarySortOrders[sort])
+
+	rows, err := db.pool.Query(context.Background(), str, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decks := []LibraryDeck{}
+	for rows.Next() {
+		var deck LibraryDeck
+		var rank float32
+		var matchingCards int
+		err := rows.Scan(
+			&deck.ID, &deck.Name, &deck.Description, &deck.Subject, &deck.Language,
+			&deck.CoverAsset, &deck.Copies, &deck.PublishedAt,
+			&deck.CardCount, &rank, &matchingCards,
+		)
+		if err != nil {
+			return nil, err
+		}
+		decks = append(decks, deck)
+	}
+
+	return decks, rows.Err()
+}
+
+func (db *Database) getPublishedDeck(deckId int) (Deck, error) {
+	str := `
+		select Name, Description, Subject, Language, CoverAsset from Decks
+		where ID = $1 and Published and not Hidden and DeletedAt is null`
+	deck := Deck{ID: deckId}
+	err := db.pool.QueryRow(context.Background(), str, deckId).Scan(
+		&deck.Name, &deck.Description, &deck.Subject, &deck.Language, &deck.CoverAsset)
+	if err == pgx.ErrNoRows {
+		return Deck{}, ErrDeckNotFound
+	} else if err != nil {
+		return Deck{}, err
+	}
+
+	deck.Cards, err = db.getFlashcards(deckId)
+	return deck, err
+}
+
+// Copy a published deck into the user's own decks. The cover
+// isn't copied since it's an asset that belongs to the deck's owner
+func (db *Database) copyPublishedDeck(userId string, deckId int) (Deck, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return Deck{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var m DeckMetadata
+	str := `
+		update Decks set Copies = Copies + 1
+		where ID = $1 and Published and not Hidden and DeletedAt is null
+		returning Name, Description, Subject, Language`
+	err = tx.QueryRow(context.Background(), str, deckId).Scan(
+		&m.Name, &m.Description, &m.Subject, &m.Language)
+	if err == pgx.ErrNoRows {
+		return Deck{}, ErrDeckNotFound
+	} else if err != nil {
+		return Deck{}, err
+	}
+
+	var newId int
+	str = `
+		insert into Decks (UserID, Name, Description, Subject, Language)
+		values ($1, $2, $3, $4, $5) returning ID`
+	err = tx.QueryRow(
+		context.Background(), str, userId, m.Name, m.Description, m.Subject, m.Language,
+	).Scan(&newId)
+	if err != nil {
+		return Deck{}, err
+	}
+
+	str = `
+		insert into Flashcards (DeckID, Front, Back, Position)
+		select $1, Front, Back, Position from Flashcards
+		where DeckID = $2 and DeletedAt is null`
+	_, err = tx.Exec(context.Background(), str, newId, deckId)
+	if err != nil {
+		return Deck{}, err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return Deck{}, err
+	}
+
+	cards, err := db.getFlashcards(newId)
+	return Deck{ID: newId, DeckMetadata: m, Cards: cards}, err
+}
+
+// Flag a published deck for moderation. Users can't flag their own
+// decks, and flagging a deck twice only counts once
+func (db *Database) flagDeck(userId string, deckId int, reason string) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var ownerId string
+	str := "select UserID from Decks where ID = $1 and Published and DeletedAt is null"
+	err = tx.QueryRow(context.Background(), str, deckId).Scan(&ownerId)
+	if err == pgx.ErrNoRows || (err == nil && ownerId == userId) {
+		return ErrDeckNotFound
+	} else if err != nil {
+		return err
+	}
+
+	str = `
+		insert into DeckFlags (DeckID, UserID, Reason) values ($1, $2, $3)
+		on conflict (DeckID, UserID) do nothing`
+	_, err = tx.Exec(context.Background(), str, deckId, userId, reason)
+	if err != nil {
+		return err
+	}
+
+	str = `
+		update Decks d set Hidden = true where ID = $1
+		and (
+			select count(*) from DeckFlags f where f.DeckID = $1
+			and (d.ReviewedAt is null or f.CreatedAt > d.ReviewedAt)
+		) >= $2`
+	_, err = tx.Exec(context.Background(), str, deckId, flagThreshold)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (db *Database) isModerator(userId string) (bool, error) {
+	var moderator bool
+	str := "select Moderator from Users where ID = $1"
+	err := db.pool.QueryRow(context.Background(), str, userId).Scan(&moderator)
+	if err == pgx.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	return moderator, err
+}
+
+// Get the decks with flags that haven't been reviewed, most flagged first
+func (db *Database) getFlaggedDecks() ([]FlaggedDeck, error) {
+	str := `
+		select d.ID, d.Name, d.Hidden, count(*), array_agg(f.Reason order by f.CreatedAt)
+		from Decks d join DeckFlags f on f.DeckID = d.ID
+		where d.Published and d.DeletedAt is null
+		and (d.ReviewedAt is null or f.CreatedAt > d.ReviewedAt)
+		group by d.ID
+		order by count(*) desc, d.ID`
+	rows, err := db.pool.Query(context.Background(), str)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decks := []FlaggedDeck{}
+	for rows.Next() {
+		var deck FlaggedDeck
+		err := rows.Scan(&deck.ID, &deck.Name, &deck.Hidden, &deck.Flags, &deck.Reasons)
+		if err != nil {
+			return nil, err
+		}
+		decks = append(decks, deck)
+	}
+
+	return decks, rows.Err()
+}
+
+// Hide a published deck or bring it back. Either way, the deck's
+// current flags have been dealt with
+func (db *Database) reviewDeck(deckId int, hidden bool) error {
+	str := `
+		update Decks set Hidden = $2, ReviewedAt = now()
+		where ID = $1 and Published and DeletedAt is null`
+	tag, err := db.pool.Exec(context.Background(), str, deckId, hidden)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrDeckNotFound
+	}
+	return nil
+}
+
+// Extract the user's ID from the request header,
+// ensuring the user is a moderator
+func (app *App) getModeratorID(ctx *gin.Context) (string, error) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	moderator, err := app.db.isModerator(userId)
+	if err != nil {
+		return "", err
+	}
+	if !moderator {
+		return "", ErrNotModerator
+	}
+	return userId, nil
+}
+
+type PublishDeckData struct {
+	Published *bool `json:"published" binding:"required"`
+}
+
+func (app *App) PublishDeck(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data PublishDeckData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	err = app.db.publishDeck(userId, deckId, *data.Published)
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+// Search the public library. Results are sorted by relevance when
+// there's a search query and by popularity otherwise
+func (app *App) SearchLibrary(ctx *gin.Context) {
+	query := ctx.Query("q")
+
+	sort := ctx.DefaultQuery("sort", "relevance")
+	if _, ok := librarySortOrders[sort]; !ok {
+		handleResponse(ctx, http.StatusBadRequest, "invalid sort order")
+		return
+	}
+	if sort == "relevance" && query == "" {
+		sort = "popular"
+	}
+
+	page := parseQueryInt(ctx.Query("page"), 1, 1, 1000)
+	limit := parseQueryInt(ctx.Query("limit"), 20, 1, 100)
+
+	decks, err := app.db.searchLibrary(query, sort, limit, (page-1)*limit)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"decks": decks, "page": page, "limit": limit}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+func (app *App) GetLibraryDeck(ctx *gin.Context) {
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	deck, err := app.db.getPublishedDeck(deckId)
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, deck)
+}
+
+func (app *App) CopyLibraryDeck(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	deck, err := app.db.copyPublishedDeck(userId, deckId)
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, deck)
+}
+
+type FlagDeckData struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+func (app *App) FlagLibraryDeck(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data FlagDeckData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if !slices.Contains(flagReasons, data.Reason) {
+		handleResponse(ctx, http.StatusBadRequest, "invalid reason")
+		return
+	}
+
+	err = app.db.flagDeck(userId, deckId, data.Reason)
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+func (app *App) GetFlaggedDecks(ctx *gin.Context) {
+	_, err := app.getModeratorID(ctx)
+	if err == ErrNotModerator {
+		handleResponse(ctx, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	decks, err := app.db.getFlaggedDecks()
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, map[string]any{"decks": decks})
+}
+
+type ReviewDeckData struct {
+	Hidden *bool `json:"hidden" binding:"required"`
+}
+
+func (app *App) ReviewLibraryDeck(ctx *gin.Context) {
+	_, err := app.getModeratorID(ctx)
+	if err == ErrNotModerator {
+		handleResponse(ctx, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data ReviewDeckData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	err = app.db.reviewDeck(deckId, *data.Hidden)
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
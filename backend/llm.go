@@ -73,32 +73,68 @@ func promptGroqLLM(payload Payload, apiKey string) (map[string]any, error) {
 	return responseJson, nil
 }
 
-// Parse flashcard json info from the llm response
-func extractCards(response map[string]any) ([]Card, error) {
+// Get the content of the message in the llm response
+func extractContent(response map[string]any) (string, error) {
 	choices, ok := response["choices"].([]any)
 	if !ok || len(choices) == 0 {
-		return nil, errors.New("missing or invalid choices")
+		return "", errors.New("missing or invalid choices")
 	}
 
 	choice, ok := choices[0].(map[string]any)
 	if !ok {
-		return nil, errors.New("choice[0] is not a map")
+		return "", errors.New("choice[0] is not a map")
 	}
 
 	message, ok := choice["message"].(map[string]any)
 	if !ok {
-		return nil, errors.New("missing or invalid message")
+		return "", errors.New("missing or invalid message")
 	}
 
 	content, ok := message["content"].(string)
 	if !ok {
-		return nil, errors.New("missing or invalid content string")
+		return "", errors.New("missing or invalid content string")
+	}
+	return content, nil
+}
+
+// The tokens (and images) a request to the llm used up
+type Usage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+	Images           int `json:"images"`
+}
+
+// Get the token counts from the usage field of the llm response
+func extractUsage(response map[string]any) Usage {
+	fields, _ := response["usage"].(map[string]any)
+	count := func(name string) int {
+		n, _ := fields[name].(float64)
+		return int(n)
+	}
+
+	usage := Usage{
+		PromptTokens:     count("prompt_tokens"),
+		CompletionTokens: count("completion_tokens"),
+		TotalTokens:      count("total_tokens"),
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage
+}
+
+// Parse flashcard json info from the llm response
+func extractCards(response map[string]any) ([]Card, error) {
+	content, err := extractContent(response)
+	if err != nil {
+		return nil, err
 	}
 
 	var contentData struct {
 		Cards []Card `json:"cards"`
 	}
-	err := json.Unmarshal([]byte(content), &contentData)
+	err = json.Unmarshal([]byte(content), &contentData)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse content JSON: %w", err)
 	}
@@ -109,7 +145,7 @@ func extractCards(response map[string]any) ([]Card, error) {
 // Create a a bunch of flashcard drafts from a batch of assets
 func createFlashcardDrafts(
 	apiKey string, userId string, files []*multipart.FileHeader,
-) ([]Card, error) {
+) ([]Card, Usage, error) {
 	// Create the request payload
 	NumCards := len(files) * 10 // generate 10 flashcards per assets
 	promptContent, err := parseTemplate(
@@ -117,7 +153,7 @@ func createFlashcardDrafts(
 		struct{ NumCards int }{NumCards},
 	)
 	if err != nil {
-		return nil, err
+		return nil, Usage{}, err
 	}
 
 	textPrompts := []Prompt{{Type: "text", Text: promptContent}}
@@ -127,13 +163,13 @@ func createFlashcardDrafts(
 		reader, err := file.Open()
 		if err != nil {
 			reader.Close()
-			return nil, err
+			return nil, Usage{}, err
 		}
 		reader.Close()
 
 		content, err := base64EncodeFile(reader, file.Header.Get("Content-Type"))
 		if err != nil {
-			return nil, err
+			return nil, Usage{}, err
 		}
 
 		prompt := Prompt{
@@ -157,17 +193,19 @@ func createFlashcardDrafts(
 	// Prompt the llm and get the cards
 	response, err := promptGroqLLM(payload, apiKey)
 	if err != nil {
-		return nil, err
+		return nil, Usage{}, err
 	}
 
+	usage := extractUsage(response)
+	usage.Images = len(files)
 	cards, err := extractCards(response)
-	return cards, err
+	return cards, usage, err
 }
 
 // Create a flashcard deck from a bunch of flashcard drafts
 func createFlashcardDeck(
 	apiKey string, userId string, drafts []Card, deckSize int,
-) ([]Card, error) {
+) ([]Card, Usage, error) {
 	// Create the request payload
 	t := struct {
 		DeckSize int
@@ -178,7 +216,7 @@ func createFlashcardDeck(
 	}
 	promptContent, err := parseTemplate("templates/combine-prompt.template", t)
 	if err != nil {
-		return nil, err
+		return nil, Usage{}, err
 	}
 
 	payload := Payload{
@@ -193,9 +231,119 @@ func createFlashcardDeck(
 
 	response, err := promptGroqLLM(payload, apiKey)
 	if err != nil {
-		return nil, err
+		return nil, Usage{}, err
 	}
 
 	cards, err := extractCards(response)
-	return cards, nil
+	return cards, extractUsage(response), err
+}
+
+// Have the llm grade a typed answer to a card. Returns a score between 0
+// (completely wrong) and 1 (completely right) along with some feedback
+func gradeAnswer(
+	apiKey string, userId string, card Card, answer string,
+) (float64, string, Usage, error) {
+	t := struct{ Front, Back, Answer string }{card.Front, card.Back, answer}
+	promptContent, err := parseTemplate("templates/grade.template", t)
+	if err != nil {
+		return 0, "", Usage{}, err
+	}
+
+	payload := Payload{
+		Model:  "meta-llama/llama-4-scout-17b-16e-instruct",
+		UserId: userId,
+		Messages: []Message{
+			{Role: "user", Content: []Prompt{{Type: "text", Text: promptContent}}},
+		},
+		ResponseFormat: map[string]string{"type": "json_object"},
+		Temperature:    0,
+	}
+
+	response, err := promptGroqLLM(payload, apiKey)
+	if err != nil {
+		return 0, "", Usage{}, err
+	}
+
+	usage := extractUsage(response)
+	content, err := extractContent(response)
+	if err != nil {
+		return 0, "", usage, err
+	}
+
+	var grade struct {
+		Score    float64 `json:"score"`
+		Feedback string  `json:"feedback"`
+	}
+	if err := json.Unmarshal([]byte(content), &grade); err != nil {
+		return 0, "", usage, fmt.Errorf("failed to parse content JSON: %w", err)
+	}
+
+	return min(max(grade.Score, 0), 1), grade.Feedback, usage, nil
+}
+
+// Have the llm explain the answer to a card and come up with hints for it.
+// The images are the assets the card's deck was generated from
+func explainCard(
+	apiKey string, userId string, card Card, images []Asset,
+) (Explanation, Usage, error) {
+	t := struct {
+		Front, Back string
+		HasImages   bool
+		HintCount   int
+	}{card.Front, card.Back, len(images) > 0, hintCount}
+	promptContent, err := parseTemplate("templates/explain.template", t)
+	if err != nil {
+		return Explanation{}, Usage{}, err
+	}
+
+	imagePrompts := []Prompt{}
+	for _, image := range images {
+		content, err := base64EncodeFile(bytes.NewReader(image.Data), image.Mimetype)
+		if err != nil {
+			return Explanation{}, Usage{}, err
+		}
+		prompt := Prompt{Type: "image_url", Image: &ImageUrl{Url: content}}
+		imagePrompts = append(imagePrompts, prompt)
+	}
+
+	messages := []Message{}
+	if len(imagePrompts) > 0 {
+		messages = append(messages, Message{Role: "user", Content: imagePrompts})
+	}
+	messages = append(messages, Message{
+		Role: "user", Content: []Prompt{{Type: "text", Text: promptContent}},
+	})
+
+	payload := Payload{
+		Model:          "meta-llama/llama-4-scout-17b-16e-instruct",
+		UserId:         userId,
+		Messages:       messages,
+		ResponseFormat: map[string]string{"type": "json_object"},
+		Temperature:    0.3,
+	}
+
+	response, err := promptGroqLLM(payload, apiKey)
+	if err != nil {
+		return Explanation{}, Usage{}, err
+	}
+
+	usage := extractUsage(response)
+	usage.Images = len(images)
+	content, err := extractContent(response)
+	if err != nil {
+		return Explanation{}, usage, err
+	}
+
+	var explanation Explanation
+	if err := json.Unmarshal([]byte(content), &explanation); err != nil {
+		return Explanation{}, usage, fmt.Errorf("failed to parse content JSON: %w", err)
+	}
+
+	if explanation.Explanation == "" {
+		return Explanation{}, usage, errors.New("missing explanation")
+	}
+	if len(explanation.Hints) > hintCount {
+		explanation.Hints = explanation.Hints[:hintCount]
+	}
+	return explanation, usage, nil
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -16,6 +22,13 @@ type App struct {
 	db          Database
 	secrets     map[string]string
 	maxFileSize int64
+	sessions    *SessionCache
+	keys        *Keyset
+	providers   map[string]*OIDCProvider
+	challenge   SignupChallenge
+	quotas      map[string]PlanQuotas
+	limiter     RateLimiter
+	limits      RateLimits
 }
 
 func NewApp() (App, error) {
@@ -26,8 +39,41 @@ func NewApp() (App, error) {
 		return App{}, err
 	}
 
+	keys, err := loadKeyset(secrets)
+	if err != nil {
+		return App{}, err
+	}
+
+	providers, err := loadOIDCProviders(secrets)
+	if err != nil {
+		return App{}, err
+	}
+
+	challenge, err := loadSignupChallenge(secrets, db)
+	if err != nil {
+		return App{}, err
+	}
+
+	quotas, err := loadQuotas(secrets)
+	if err != nil {
+		return App{}, err
+	}
+
+	limiter, err := loadRateLimiter(secrets, db)
+	if err != nil {
+		return App{}, err
+	}
+
+	limits, err := loadRateLimits(secrets)
+	if err != nil {
+		return App{}, err
+	}
+
 	maxFileSize := int64(32 << 20) // 32 megabytes
-	return App{db, secrets, maxFileSize}, nil
+	return App{
+		db, secrets, maxFileSize, NewSessionCache(),
+		keys, providers, challenge, quotas, limiter, limits,
+	}, nil
 }
 
 // Each batch should hold at most 2 files
@@ -51,6 +97,14 @@ func handleResponse(ctx *gin.Context, statusCode int, object any) {
 		message = "Internal server error"
 	} else if statusCode == http.StatusBadRequest {
 		message = "Invalid request"
+	} else if statusCode == http.StatusConflict {
+		message = "Conflicting edit"
+	} else if statusCode == http.StatusUnauthorized {
+		message = "Unauthorized"
+	} else if statusCode == http.StatusForbidden {
+		message = "Forbidden"
+	} else if statusCode == http.StatusTooManyRequests {
+		message = "Too many requests"
 	}
 
 	if statusCode != http.StatusOK {
@@ -62,66 +116,93 @@ func handleResponse(ctx *gin.Context, statusCode int, object any) {
 	}
 }
 
+// Parse the integer id in the request's url path
+func pathID(ctx *gin.Context) (int, error) { return strconv.Atoi(ctx.Param("id")) }
+
 // Extract the user'd ID from the request header and
 // ensure the user exists, then return it
 func (app *App) getUserID(ctx *gin.Context) (string, error) {
+	userId, _, err := app.getSession(ctx)
+	return userId, err
+}
+
+// The key the authenticated session is stored under in the request's
+// context, so that checking it again in the same request is free
+const sessionContextKey = "session"
+
+// Extract the user's ID and session ID from the request header,
+// ensuring the user exists and the session wasn't revoked
+func (app *App) getSession(ctx *gin.Context) (string, string, error) {
+	if ids, ok := ctx.Get(sessionContextKey); ok {
+		session := ids.([2]string)
+		return session[0], session[1], nil
+	}
+
 	tokenStr := ctx.GetHeader("Authorization")
 	if len(strings.Trim(tokenStr, " ")) == 0 {
-		return "", fmt.Errorf("no jwt found")
+		return "", "", fmt.Errorf("no jwt found")
 	}
 
 	if tokenStr[0] == '"' { // Remove quotes if present
 		tokenStr = tokenStr[1 : len(tokenStr)-1]
 	}
-	token, err := parseToken(tokenStr, []byte(app.secrets["JWT_SECRET"]))
-	if err != nil {
-		return "", fmt.Errorf("invalid json web token")
-	}
-
-	// Check if the token is about to get expired
-	expiryTime, err := token.Claims.GetExpirationTime()
-	if err != nil {
-		return "", err
+	// Clients are expected to refresh their access token once it expires.
+	// Tokens issued before sessions existed are signed properly but don't have
+	// an issuer, audience or session, so they're treated as expired too, which
+	// sends their users back to log in
+	token, err := parseToken(tokenStr, app.keys)
+	if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+		return "", "", jwt.ErrTokenExpired
+	} else if err != nil {
+		return "", "", fmt.Errorf("invalid json web token")
 	}
 
-	closeToExpiring := time.Until(expiryTime.Time).Hours() <= 24
-	if closeToExpiring {
-		return "", jwt.ErrTokenExpired
+	claims := token.Claims.(*TokenClaims)
+	if claims.Subject == "" {
+		return "", "", fmt.Errorf("json web token doesn't contain the user's id")
+	} else if claims.SessionID == "" {
+		return "", "", jwt.ErrTokenExpired
 	}
 
-	userId, err := token.Claims.GetSubject()
+	revoked, err := app.sessionRevoked(claims.Subject, claims.SessionID)
 	if err != nil {
-		return "", fmt.Errorf("json web token doesn't contain the user's id")
+		return "", "", err
+	}
+	if revoked {
+		return "", "", ErrSessionRevoked
 	}
 
-	exists, err := app.db.userExists(userId)
+	exists, err := app.db.userExists(claims.Subject)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if !exists {
-		return "", fmt.Errorf("user not found")
+		return "", "", fmt.Errorf("user not found")
 	}
 
-	return userId, nil
+	ctx.Set(sessionContextKey, [2]string{claims.Subject, claims.SessionID})
+	return claims.Subject, claims.SessionID, nil
 }
 
 type AuthUserData struct {
 	Email           string `json:"email" binding:"required"`
 	Password        string `json:"password" binding:"required"`
 	ExistingAccount *bool  `json:"existing" binding:"required"`
+	// The answer to the signup challenge, which is only needed when signing up
+	Challenge *ChallengeAnswer `json:"challenge"`
 }
 
-func (app *App) emailUser(recipient, authLink string) error {
-	data := struct{ Link string }{Link: authLink}
-	content, err := parseTemplate("templates/email.template", data)
+// Send the user an email holding a link, written using an html template
+func (app *App) emailUser(recipient, subject, templatePath, link string) error {
+	data := struct{ Link string }{Link: link}
+	content, err := parseTemplate(templatePath, data)
 	if err != nil {
 		return err
 	}
 
 	info := EmailInfo{
-		recipient: recipient, content: content,
-		subject:  "Snapcram email authentication",
+		recipient: recipient, content: content, subject: subject,
 		sender:   app.secrets["GMAIL_ADDRESS"],
 		username: app.secrets["GMAIL_ADDRESS"],
 		password: app.secrets["GMAIL_APP_PASSWORD"],
@@ -136,18 +217,57 @@ func (app *App) AuthenticateUser(ctx *gin.Context) {
 		return
 	}
 
+	ipKey, accountKey := ipThrottleKey(ctx.ClientIP()), accountThrottleKey(data.Email)
+	attempt, ok := app.reserveAttempt(ctx, ipKey, accountKey)
+	if !ok {
+		return
+	}
+	// The keys the attempt failed for, it's forgiven for the others
+	var failed []throttleKey
+	defer func() { app.settleAttempt(attempt, failed...) }()
+
+	if !*data.ExistingAccount {
+		if len(data.Password) < minPasswordLength {
+			handleResponse(ctx, http.StatusNotAcceptable, ErrPasswordTooShort.Error())
+			return
+		}
+
+		answer := ChallengeAnswer{}
+		if data.Challenge != nil {
+			answer = *data.Challenge
+		}
+
+		err := app.challenge.verify(answer, ctx.ClientIP())
+		if err == ErrChallengeFailed {
+			handleResponse(ctx, http.StatusBadRequest, err.Error())
+			return
+		} else if err != nil {
+			handleResponse(ctx, http.StatusInternalServerError, nil)
+			return
+		}
+	}
+
 	userId, err := app.db.validateUserCredentials(data.Email, data.Password)
 
 	if *data.ExistingAccount { // Loggin in
+		// Don't reveal whether the account exists
 		if err == ErrUserNotFound || err == ErrWrongPassword {
-			handleResponse(ctx, http.StatusNotAcceptable, err.Error())
+			failed = []throttleKey{ipKey, accountKey}
+			handleResponse(ctx, http.StatusNotAcceptable, ErrInvalidCredentials.Error())
 			return
 		} else if err != nil {
 			handleResponse(ctx, http.StatusInternalServerError, nil)
 			return
 		}
+
+		if err := app.db.clearFailures(accountKey); err != nil {
+			handleResponse(ctx, http.StatusInternalServerError, nil)
+			return
+		}
 	} else { // Creating an account
-		if err == nil {
+		if err == nil || err == ErrWrongPassword {
+			// Probing for existing emails counts against the ip
+			failed = []throttleKey{ipKey}
 			handleResponse(ctx, http.StatusNotAcceptable, "user already exists")
 			return
 		} else if err != ErrUserNotFound {
@@ -158,26 +278,31 @@ func (app *App) AuthenticateUser(ctx *gin.Context) {
 		// Insert a new user into the database
 		userId = uuid.NewString()
 		err := app.db.insertUser(data.Email, data.Password, userId)
-		if err != nil {
+		if isUniqueViolation(err) {
+			handleResponse(ctx, http.StatusNotAcceptable, "user already exists")
+			return
+		} else if err != nil {
 			handleResponse(ctx, http.StatusInternalServerError, nil)
 			return
 		}
-	}
 
-	// Respond with a json web token containing the user id
-	tokenStr, err := createToken([]byte(app.secrets["JWT_SECRET"]), userId)
-	if err != nil {
-		handleResponse(ctx, http.StatusInternalServerError, nil)
-		return
+		// The account can be used right away, the user
+		// can ask for another link if this one doesn't arrive
+		go func() {
+			if err := app.sendVerificationEmail(userId, data.Email); err != nil {
+				log.Printf("sending a verification email failed: %v", err)
+			}
+		}()
 	}
 
-	response := map[string]string{"token": tokenStr}
-	handleResponse(ctx, http.StatusOK, response)
+	// Respond with an access token containing the user id, along
+	// with the refresh token used to get new access tokens
+	app.logIn(ctx, userId)
 }
 
 // Response with all of the user's decks
 func (app *App) GetUserInfo(ctx *gin.Context) {
-	response := map[string]any{"decks": nil, "tokenExpired": true}
+	response := map[string]any{"decks": nil, "tokenExpired": true, "verified": false}
 
 	userId, err := app.getUserID(ctx)
 	if err == jwt.ErrTokenExpired {
@@ -194,11 +319,105 @@ func (app *App) GetUserInfo(ctx *gin.Context) {
 		return
 	}
 
+	_, verified, err := app.db.getUserEmail(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
 	response["decks"] = decks
+	response["verified"] = verified
 	response["tokenExpired"] = false
 	handleResponse(ctx, http.StatusOK, response)
 }
 
+// Respond with a page of the user's deck summaries,
+// optionally filtered by tag or folder
+func (app *App) ListDecks(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var after *DeckSummary
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		values, err := decodeCursor(cursor, 2)
+		if err != nil {
+			handleResponse(ctx, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		after = &DeckSummary{UpdatedAt: time.UnixMicro(values[0]), ID: int(values[1])}
+	}
+
+	filter := DeckFilter{
+		Tag:      strings.ToLower(strings.TrimSpace(ctx.Query("tag"))),
+		FolderID: parseQueryInt(ctx.Query("folder"), 0, 0, math.MaxInt32),
+	}
+
+	limit := parseQueryInt(ctx.Query("limit"), 20, 1, 100)
+	decks, err := app.db.getDeckSummaries(userId, filter, after, limit)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"decks": decks, "nextCursor": nil}
+	if len(decks) == limit {
+		last := decks[len(decks)-1]
+		response["nextCursor"] = encodeCursor(last.UpdatedAt.UnixMicro(), int64(last.ID))
+	}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+// Respond with a page of the cards in one of the user's decks
+func (app *App) GetDeckCards(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var after *Card
+	if cursor := ctx.Query("cursor"); cursor != "" {
+		values, err := decodeCursor(cursor, 2)
+		if err != nil {
+			handleResponse(ctx, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		after = &Card{Position: int(values[0]), ID: int(values[1])}
+	}
+
+	exists, err := app.db.deckExists(userId, deckId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	} else if !exists {
+		handleResponse(ctx, http.StatusNotFound, ErrDeckNotFound.Error())
+		return
+	}
+
+	limit := parseQueryInt(ctx.Query("limit"), 50, 1, 200)
+	cards, err := app.db.getFlashcardsPage(deckId, after, limit)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"cards": cards, "nextCursor": nil}
+	if len(cards) == limit {
+		last := cards[len(cards)-1]
+		response["nextCursor"] = encodeCursor(int64(last.Position), int64(last.ID))
+	}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
 // Generate a set of flashcards using the uploaded files. Those
 // flashcards will then be used to create a flashcard deck
 func (app *App) GenerateFlashcards(ctx *gin.Context) {
@@ -237,20 +456,35 @@ func (app *App) GenerateFlashcards(ctx *gin.Context) {
 		}
 	}
 
-	flashcards, err := createFlashcardDrafts(app.secrets["GROQ_API_KEY"], userId, files)
+	if !app.checkQuota(ctx, userId, len(files)) {
+		return
+	}
+
+	flashcards, usage, err := createFlashcardDrafts(
+		app.secrets["GROQ_API_KEY"], userId, files)
+	app.recordUsage(userId, usageGenerate, usage)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	// Keep the files so they can be attached to the deck once it's created
+	assets, err := app.db.insertAssets(userId, files)
 	if err != nil {
 		handleResponse(ctx, http.StatusInternalServerError, nil)
 		return
 	}
 
-	response := map[string]any{"cards": flashcards}
+	response := map[string]any{"cards": flashcards, "assets": assets}
 	handleResponse(ctx, http.StatusOK, response)
 }
 
+// Assets are the ids of the assets the drafts were generated from
 type CreateDeckData struct {
-	Name           string `json:"name" binding:"required"`
-	DeckSize       int    `json:"size" binding:"required"`
-	FlashcardDrafs []Card `json:"drafts" binding:"required"`
+	Name           string   `json:"name" binding:"required"`
+	DeckSize       int      `json:"size" binding:"required"`
+	FlashcardDrafs []Card   `json:"drafts" binding:"required"`
+	Assets         []string `json:"assets"`
 }
 
 // Create a flashcard deck using previously generated flashcard drafts
@@ -267,15 +501,26 @@ func (app *App) CreateDeck(ctx *gin.Context) {
 		return
 	}
 
-	cards, err := createFlashcardDeck(
+	if err := validateMetadata(MetadataEdit{Name: &data.Name}); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !app.checkQuota(ctx, userId, 0) {
+		return
+	}
+
+	cards, usage, err := createFlashcardDeck(
 		app.secrets["GROQ_API_KEY"], userId, data.FlashcardDrafs, data.DeckSize,
 	)
+	app.recordUsage(userId, usageDeck, usage)
 	if err != nil {
 		handleResponse(ctx, http.StatusInternalServerError, nil)
 		return
 	}
 
-	id, err := app.db.insertDeck(userId, Deck{Name: data.Name, Cards: cards})
+	deck := Deck{DeckMetadata: DeckMetadata{Name: data.Name}, Cards: cards}
+	id, err := app.db.insertDeck(userId, deck, data.Assets)
 	if err != nil {
 		handleResponse(ctx, http.StatusInternalServerError, nil)
 		return
@@ -303,7 +548,10 @@ func (app *App) DeleteDeck(ctx *gin.Context) {
 	}
 
 	err = app.db.deleteDeck(userId, data.ID)
-	if err != nil {
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
 		handleResponse(ctx, http.StatusInternalServerError, nil)
 		return
 	}
@@ -311,9 +559,42 @@ func (app *App) DeleteDeck(ctx *gin.Context) {
 	handleResponse(ctx, http.StatusOK, nil)
 }
 
+// Order optionally holds the ids of the deck's cards in their new order.
+// It's applied after the card edits, so new cards end up at the end.
+// Version is the version of the deck the client edited
 type EditDeckData struct {
-	ID    int          `json:"id" binding:"required"`
-	Cards []EditedCard `json:"cards" binding:"required"`
+	ID       int          `json:"id" binding:"required"`
+	Version  *int         `json:"version"`
+	Metadata MetadataEdit `json:"metadata"`
+	Cards    []EditedCard `json:"cards"`
+	Order    []int        `json:"order"`
+}
+
+var languageTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// Make sure the edited metadata fields are valid, trimming
+// the whitespace around the name along the way
+func validateMetadata(m MetadataEdit) error {
+	if m.Name != nil {
+		*m.Name = strings.TrimSpace(*m.Name)
+		if len(*m.Name) == 0 || utf8.RuneCountInString(*m.Name) > 100 {
+			return fmt.Errorf("deck name must be between 1 and 100 characters")
+		}
+	}
+
+	if m.Description != nil && utf8.RuneCountInString(*m.Description) > 1000 {
+		return fmt.Errorf("description can't be longer than 1000 characters")
+	}
+
+	if m.Subject != nil && utf8.RuneCountInString(*m.Subject) > 100 {
+		return fmt.Errorf("subject can't be longer than 100 characters")
+	}
+
+	if m.Language != nil && *m.Language != "" && !languageTag.MatchString(*m.Language) {
+		return fmt.Errorf("language must be a language tag (ex. en or pt-BR)")
+	}
+
+	return nil
 }
 
 func (app *App) EditDeck(ctx *gin.Context) {
@@ -329,13 +610,43 @@ func (app *App) EditDeck(ctx *gin.Context) {
 		return
 	}
 
-	newCards, err := app.db.updateDeck(userId, data.ID, data.Cards)
-	if err != nil {
+	if err := validateMetadata(data.Metadata); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	seen := map[int]bool{}
+	for _, id := range data.Order {
+		if seen[id] {
+			handleResponse(ctx, http.StatusBadRequest, "duplicate card in order")
+			return
+		}
+		seen[id] = true
+	}
+
+	deck, err := app.db.updateDeck(
+		userId, data.ID, data.Version, data.Metadata, data.Cards, data.Order)
+	if err == ErrVersionConflict {
+		// Send back what's on the server so the client can merge its edits
+		deck, err := app.db.getDeck(userId, data.ID)
+		if err != nil {
+			handleResponse(ctx, http.StatusInternalServerError, nil)
+			return
+		}
+		handleResponse(ctx, http.StatusConflict, map[string]any{"deck": deck})
+		return
+	} else if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err == ErrInvalidCoverAsset {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
 		handleResponse(ctx, http.StatusInternalServerError, nil)
 		return
 	}
 
-	response := map[string]any{"cards": newCards}
+	response := map[string]any{"cards": deck.Cards, "version": deck.Version, "deck": deck}
 	handleResponse(ctx, http.StatusOK, response)
 }
 
@@ -352,17 +663,91 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	runEvery(time.Hour, "purging the trash", app.db.purgeTrash)
+	runEvery(10*time.Minute, "optimizing scheduling parameters", app.db.optimizeParameters)
+	runEvery(time.Hour, "pruning sessions", app.db.pruneSessions)
+	runEvery(time.Hour, "pruning email tokens", app.db.pruneEmailTokens)
+	runEvery(time.Hour, "pruning sign in states", app.db.pruneOIDCStates)
+	runEvery(time.Hour, "pruning login attempts", app.db.pruneLoginAttempts)
+	runEvery(time.Hour, "pruning rate limit buckets", app.limiter.prune)
+
 	server := gin.Default()
 	server.MaxMultipartMemory = app.fileUploadLimit()
+	if err := server.SetTrustedProxies(app.trustedProxies()); err != nil {
+		panic(err)
+	}
+	server.Use(app.rateLimit)
 
 	server.POST("/authenticate", app.AuthenticateUser)
+	server.GET("/auth/challenge", app.GetSignupChallenge)
+	server.POST("/auth/refresh", app.RefreshTokens)
+	server.POST("/auth/verify", app.VerifyEmail)
+	server.POST("/auth/verify/resend", app.ResendVerification)
+	server.POST("/auth/reset/request", app.RequestPasswordReset)
+	server.POST("/auth/reset", app.ResetPassword)
+	server.POST("/auth/2fa/enroll", app.EnrollTOTP)
+	server.POST("/auth/2fa/confirm", app.ConfirmTOTP)
+	server.POST("/auth/2fa/verify", app.VerifyTOTP)
+	server.POST("/auth/2fa/disable", app.DisableTOTP)
+	server.POST("/auth/2fa/recovery-codes", app.RegenerateRecoveryCodes)
+	server.GET("/auth/oidc", app.GetOIDCProviders)
+	server.POST("/auth/oidc/:provider/start", app.StartOIDC)
+	server.POST("/auth/oidc/:provider/callback", app.FinishOIDC)
+	server.GET("/identities", app.GetIdentities)
+	server.DELETE("/identities/:provider", app.UnlinkIdentity)
+	server.GET("/.well-known/jwks.json", app.GetJWKS)
+	server.GET("/sessions", app.GetSessions)
+	server.DELETE("/sessions", app.RevokeSession)
+	server.DELETE("/sessions/:id", app.RevokeSession)
 	server.GET("/userInfo", app.GetUserInfo)
+	server.GET("/account/export", app.ExportAccount)
+	server.DELETE("/account", app.DeleteAccount)
 
 	server.POST("/generate", app.GenerateFlashcards)
+	server.GET("/usage", app.GetUsage)
 
+	server.GET("/decks", app.ListDecks)
+	server.GET("/deck/:id/cards", app.GetDeckCards)
 	server.POST("/deck", app.CreateDeck)
 	server.PATCH("/deck", app.EditDeck)
 	server.DELETE("/deck", app.DeleteDeck)
+	server.POST("/deck/:id/publish", app.PublishDeck)
+	server.POST("/deck/:id/restore", app.RestoreDeck)
+	server.POST("/card/:id/restore", app.RestoreCard)
+	server.GET("/trash", app.GetTrash)
+	server.GET("/asset/:id", app.GetAsset)
+
+	server.PUT("/deck/:id/tags", app.SetDeckTags)
+	server.PUT("/deck/:id/folder", app.SetDeckFolder)
+	server.PUT("/card/:id/tags", app.SetCardTags)
+	server.GET("/card/:id/history", app.GetCardHistory)
+	server.POST("/card/:id/revert", app.RevertCard)
+	server.POST("/card/:id/explain", app.ExplainCard)
+
+	server.GET("/tags", app.GetTags)
+	server.GET("/folders", app.GetFolders)
+	server.POST("/folder", app.CreateFolder)
+	server.PATCH("/folder/:id", app.EditFolder)
+	server.DELETE("/folder/:id", app.DeleteFolder)
+
+	server.POST("/sync", app.Sync)
+	server.GET("/search", app.SearchFlashcards)
+
+	server.POST("/review", app.ReviewCard)
+	server.GET("/stats", app.GetStats)
+	server.POST("/study/session", app.CreateStudySession)
+	server.GET("/study/session/:id", app.GetStudySession)
+	server.POST("/study/session/:id/end", app.EndStudySession)
+	server.POST("/study/answer", app.AnswerCard)
+	server.GET("/study/parameters", app.GetParameters)
+	server.POST("/study/parameters/optimize", app.OptimizeParameters)
+
+	server.GET("/library", app.SearchLibrary)
+	server.GET("/library/:id", app.GetLibraryDeck)
+	server.POST("/library/:id/copy", app.CopyLibraryDeck)
+	server.POST("/library/:id/flag", app.FlagLibraryDeck)
+	server.GET("/moderation/decks", app.GetFlaggedDecks)
+	server.POST("/moderation/deck/:id", app.ReviewLibraryDeck)
 
 	if err := server.Run(); err != nil {
 		panic(err)
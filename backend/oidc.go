@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Users can sign in through OpenID Connect identity providers, using the
+// authorization code flow with PKCE. Providers are configured through the
+// environment:
+//   - OIDC_PROVIDERS lists the ids of the providers, separated by commas
+//   - OIDC_<ID>_ISSUER is the provider's issuer url, which is
+//     used to discover the provider's endpoints
+//   - OIDC_<ID>_CLIENT_ID and OIDC_<ID>_CLIENT_SECRET are the app's
+//     credentials. The secret can be left out for public clients
+//   - OIDC_<ID>_NAME is the name shown to users, which defaults to the id
+//   - OIDC_<ID>_SCOPES defaults to "openid email profile"
+//   - OIDC_<ID>_REDIRECT_URL is where the provider sends users back to,
+//     which defaults to APP_URL/auth/callback
+//
+// The id is uppercased and dashes are replaced with underscores
+type OIDCProvider struct {
+	ID           string
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+
+	mutex        sync.Mutex
+	discovery    *OIDCDiscovery
+	discoveredAt time.Time
+	keys         map[string]any
+	keysAt       time.Time
+}
+
+type OIDCDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Some providers send email_verified as a string
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	*b = flexibleBool(value == "true")
+	return nil
+}
+
+type IDTokenClaims struct {
+	Nonce           string       `json:"nonce"`
+	Email           string       `json:"email"`
+	EmailVerified   flexibleBool `json:"email_verified"`
+	AuthorizedParty string       `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+const (
+	discoveryLifetime = time.Hour
+	// Keys are fetched again when a token is signed with an unknown key,
+	// but at most this often so bogus tokens can't hammer the provider
+	minKeyRefreshInterval = time.Minute
+	oidcStateLifetime     = 10 * time.Minute
+)
+
+var ErrOIDCProvider error = fmt.Errorf("identity provider error")
+var ErrIDTokenInvalid error = fmt.Errorf("invalid id token")
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// Plain http is only allowed for providers running locally, like mock servers
+func secureURL(raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	host := parsed.Hostname()
+	local := host == "localhost" || host == "127.0.0.1" || host == "::1"
+	return parsed.Scheme == "https" || (parsed.Scheme == "http" && local)
+}
+
+func loadOIDCProviders(secrets map[string]string) (map[string]*OIDCProvider, error) {
+	providers := map[string]*OIDCProvider{}
+	for _, id := range strings.Split(secrets["OIDC_PROVIDERS"], ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		provider := &OIDCProvider{
+			ID:           id,
+			Name:         secrets[prefix+"NAME"],
+			Issuer:       strings.TrimRight(secrets[prefix+"ISSUER"], "/"),
+			ClientID:     secrets[prefix+"CLIENT_ID"],
+			ClientSecret: secrets[prefix+"CLIENT_SECRET"],
+			Scopes:       strings.Fields(secrets[prefix+"SCOPES"]),
+			RedirectURL:  secrets[prefix+"REDIRECT_URL"],
+		}
+
+		if provider.Name == "" {
+			provider.Name = id
+		}
+		if len(provider.Scopes) == 0 {
+			provider.Scopes = []string{"openid", "email", "profile"}
+		} else if !slices.Contains(provider.Scopes, "openid") {
+			provider.Scopes = append([]string{"openid"}, provider.Scopes...)
+		}
+		if provider.RedirectURL == "" {
+			base := strings.TrimRight(secrets["APP_URL"], "/")
+			provider.RedirectURL = base + "/auth/callback"
+		}
+
+		if provider.ClientID == "" {
+			return nil, fmt.Errorf("provider %s has no client id", id)
+		}
+		if !secureURL(provider.Issuer) {
+			return nil, fmt.Errorf("provider %s needs an https issuer", id)
+		}
+		providers[id] = provider
+	}
+	return providers, nil
+}
+
+func fetchJSON(endpoint string, object any) error {
+	response, err := oidcClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", endpoint, response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(object)
+}
+
+// Get the provider's endpoints, which are cached for a while
+func (p *OIDCProvider) discover() (*OIDCDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveredAt) < discoveryLifetime {
+		return p.discovery, nil
+	}
+
+	var discovery OIDCDiscovery
+	err := fetchJSON(p.Issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovered issuer %s doesn't match", discovery.Issuer)
+	}
+	endpoints := []string{
+		discovery.AuthorizationEndpoint, discovery.TokenEndpoint, discovery.JWKSURI}
+	for _, endpoint := range endpoints {
+		if !secureURL(endpoint) {
+			return nil, fmt.Errorf("insecure endpoint %q", endpoint)
+		}
+	}
+
+	p.discovery, p.discoveredAt = &discovery, time.Now()
+	return p.discovery, nil
+}
+
+func decodeBase64URLInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+func (k JWK) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521(),
+		}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// Find the provider key with the id, fetching the provider's keys
+// when they haven't been fetched yet or the key is unknown
+func (p *OIDCProvider) signingKey(jwksURI, kid string) (any, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	find := func() any {
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key
+			}
+		}
+		return p.keys[kid]
+	}
+
+	if key := find(); key != nil {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysAt) < minKeyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := fetchJSON(jwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys, p.keysAt = map[string]any{}, time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = key
+		}
+	}
+
+	if key := find(); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Derive the PKCE code challenge from the code verifier
+func codeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func (p *OIDCProvider) authorizationURL(state, nonce, verifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Trade the authorization code for the user's id token
+func (p *OIDCProvider) exchangeCode(code, verifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	// Basic authentication is the default when providers don't list their methods
+	basic := p.ClientSecret != "" && (len(discovery.TokenAuthMethods) == 0 ||
+		slices.Contains(discovery.TokenAuthMethods, "client_secret_basic"))
+	if !basic {
+		form.Set("client_id", p.ClientID)
+		if p.ClientSecret != "" {
+			form.Set("client_secret", p.ClientSecret)
+		}
+	}
+
+	request, err := http.NewRequest(
+		"POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if basic {
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	response, err := oidcClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s %s", body.Error, body.Description)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token response has no id token")
+	}
+	return body.IDToken, nil
+}
+
+// Verify the id token's signature and claims, making sure
+// it was issued for this app and for this sign in attempt
+func (p *OIDCProvider) validateIDToken(encoded, nonce string) (*IDTokenClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	keyfunc := func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(discovery.JWKSURI, kid)
+	}
+
+	claims := &IDTokenClaims{}
+	methods := []string{
+		"RS256", "RS384", "RS512", "PS256", "PS384", "PS512",
+		"ES256", "ES384", "ES512", "EdDSA",
+	}
+	_, err = jwt.ParseWithClaims(
+		encoded, claims, keyfunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIDTokenInvalid, err)
+	}
+
+	if claims.Subject == "" || claims.Nonce != nonce {
+		return nil, ErrIDTokenInvalid
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, ErrIDTokenInvalid
+	}
+	return claims, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A local identity provider that hands out whatever id token the test sets
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// The PKCE challenge of the sign in attempt, and the token it's traded for
+	challenge   string
+	idToken     string
+	authMethods []string
+	// How the client authenticated itself in the last token request
+	authMethod string
+}
+
+const (
+	mockClientID     = "snapcram-client"
+	mockClientSecret = "snapcram-secret"
+	mockCode         = "authorization-code"
+	mockKeyID        = "mock-key"
+)
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                m.server.URL,
+			"authorization_endpoint":                m.server.URL + "/authorize",
+			"token_endpoint":                        m.server.URL + "/token",
+			"jwks_uri":                              m.server.URL + "/jwks",
+			"token_endpoint_auth_methods_supported": m.authMethods,
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		public := m.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": mockKeyID, "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		fail := func(reason string) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "invalid_grant", "error_description": reason,
+			})
+		}
+
+		if id, secret, ok := r.BasicAuth(); ok {
+			m.authMethod = "client_secret_basic"
+			if id != mockClientID || secret != mockClientSecret {
+				fail("bad client credentials")
+				return
+			}
+		} else {
+			m.authMethod = "client_secret_post"
+			if r.Form.Get("client_id") != mockClientID ||
+				r.Form.Get("client_secret") != mockClientSecret {
+				fail("bad client credentials")
+				return
+			}
+		}
+
+		if r.Form.Get("grant_type") != "authorization_code" || r.Form.Get("code") != mockCode {
+			fail("bad code")
+			return
+		}
+		if codeChallenge(r.Form.Get("code_verifier")) != m.challenge {
+			fail("bad code verifier")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": m.idToken, "token_type": "Bearer", "access_token": "unused",
+		})
+	})
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockProvider) provider() *OIDCProvider {
+	return &OIDCProvider{
+		ID: "mock", Name: "Mock", Issuer: m.server.URL,
+		ClientID: mockClientID, ClientSecret: mockClientSecret,
+		Scopes:      []string{"openid", "email"},
+		RedirectURL: "http://localhost:8081/auth/callback",
+	}
+}
+
+// Sign an id token with the provider's key, changing the claims that are given
+func (m *mockProvider) sign(t *testing.T, nonce string, change func(*IDTokenClaims)) string {
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Nonce:         nonce,
+		Email:         "user@example.com",
+		EmailVerified: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.server.URL,
+			Subject:   "subject-1",
+			Audience:  jwt.ClaimStrings{mockClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+	if change != nil {
+		change(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = mockKeyID
+	encoded, err := token.SignedString(m.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// Start a sign in attempt like the app does and
+// return the id token the provider gives back
+func (m *mockProvider) signIn(t *testing.T, p *OIDCProvider, nonce string) string {
+	verifier := "verifier-" + nonce
+	link, err := p.authorizationURL("state", nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != mockClientID || query.Get("nonce") != nonce ||
+		query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization url %s", link)
+	}
+	m.challenge = query.Get("code_challenge")
+
+	encoded, err := p.exchangeCode(mockCode, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	m.idToken = m.sign(t, "nonce-1", nil)
+
+	encoded := m.signIn(t, p, "nonce-1")
+	if m.authMethod != "client_secret_basic" {
+		t.Errorf("expected basic authentication by default, got %s", m.authMethod)
+	}
+
+	claims, err := p.validateIDToken(encoded, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "user@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
+
+func TestOIDCClientSecretPost(t *testing.T) {
+	m := newMockProvider(t)
+	m.authMethods = []string{"client_secret_post"}
+	p := m.provider()
+	m.idToken = m.sign(t, "nonce-1", nil)
+
+	m.signIn(t, p, "nonce-1")
+	if m.authMethod != "client_secret_post" {
+		t.Errorf("expected the secret to be posted, got %s", m.authMethod)
+	}
+}
+
+func TestOIDCWrongVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	m.idToken = m.sign(t, "nonce-1", nil)
+	m.challenge = codeChallenge("another verifier")
+
+	if _, err := p.exchangeCode(mockCode, "verifier"); err == nil {
+		t.Errorf("the code was exchanged with the wrong verifier")
+	}
+}
+
+func TestOIDCRejectedTokens(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		nonce  string
+		change func(*IDTokenClaims)
+	}{
+		{"nonce mismatch", "another-nonce", nil},
+		{"audience mismatch", "nonce-1", func(c *IDTokenClaims) {
+			c.Audience = jwt.ClaimStrings{"another-client"}
+		}},
+		{"issuer mismatch", "nonce-1", func(c *IDTokenClaims) {
+			c.Issuer = "https://attacker.example.com"
+		}},
+		{"expired", "nonce-1", func(c *IDTokenClaims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-10 * time.Minute))
+		}},
+		{"no subject", "nonce-1", func(c *IDTokenClaims) { c.Subject = "" }},
+		{"another authorized party", "nonce-1", func(c *IDTokenClaims) {
+			c.Audience = jwt.ClaimStrings{mockClientID, "another-client"}
+			c.AuthorizedParty = "another-client"
+		}},
+	}
+
+	for _, test := range tests {
+		encoded := m.sign(t, test.nonce, test.change)
+		_, err := p.validateIDToken(encoded, "nonce-1")
+		if !errors.Is(err, ErrIDTokenInvalid) {
+			t.Errorf("%s: expected the token to be rejected, got %v", test.name, err)
+		}
+	}
+
+	// Tokens signed with a key the provider doesn't publish
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &IDTokenClaims{Nonce: "nonce-1"})
+	token.Header["kid"] = mockKeyID
+	encoded, err := token.SignedString(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.validateIDToken(encoded, "nonce-1"); !errors.Is(err, ErrIDTokenInvalid) {
+		t.Errorf("a token signed with another key was accepted: %v", err)
+	}
+
+	// Tokens with several audiences are fine when we're the authorized party
+	encoded = m.sign(t, "nonce-1", func(c *IDTokenClaims) {
+		c.Audience = jwt.ClaimStrings{mockClientID, "another-client"}
+		c.AuthorizedParty = mockClientID
+	})
+	if _, err := p.validateIDToken(encoded, "nonce-1"); err != nil {
+		t.Errorf("a token with us as the authorized party was rejected: %v", err)
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+
+	// The provider is discovered through its issuer, which has to match
+	p.Issuer = m.server.URL + "/tenant"
+	if _, err := p.discover(); err == nil {
+		t.Errorf("a provider with a different issuer was discovered")
+	}
+}
+
+func TestLoadOIDCProviders(t *testing.T) {
+	secrets := map[string]string{
+		"OIDC_PROVIDERS":              "school-login",
+		"OIDC_SCHOOL_LOGIN_ISSUER":    "https://login.example.com/",
+		"OIDC_SCHOOL_LOGIN_CLIENT_ID": "client",
+		"APP_URL":                     "https://snapcram.example.com/",
+	}
+	providers, err := loadOIDCProviders(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := providers["school-login"]
+	if p == nil || p.Issuer != "https://login.example.com" || p.Name != "school-login" ||
+		p.RedirectURL != "https://snapcram.example.com/auth/callback" {
+		t.Errorf("unexpected provider %+v", p)
+	}
+
+	for _, issuer := range []string{"http://login.example.com", "ftp://localhost", ""} {
+		secrets["OIDC_SCHOOL_LOGIN_ISSUER"] = issuer
+		if _, err := loadOIDCProviders(secrets); err == nil {
+			t.Errorf("the issuer %q was allowed", issuer)
+		}
+	}
+}
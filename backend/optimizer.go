@@ -0,0 +1,134 @@
+package main
+
+import "math"
+
+// Fitting FSRS parameters to a user's review history. Each review of a
+// card after its first one is a prediction: the model predicts the odds
+// of recalling the card, and the review tells us whether the user did.
+// The parameters are fitted by minimizing the log loss of those predictions
+// with Adam, estimating the gradient with finite differences
+
+const (
+	optimizerSteps        = 250
+	optimizerLearningRate = 0.02
+	optimizerDelta        = 1e-4
+	// Only a sample of the user's cards is used for users with huge histories
+	maxTrainingCards = 10000
+)
+
+// The range each parameter is allowed to take, which
+// keeps the model from fitting nonsensical memory curves
+var parameterBounds = [][2]float64{
+	{0.1, 100}, {0.1, 100}, {0.1, 100}, {0.1, 100},
+	{1, 10}, {0.1, 5}, {0.1, 5}, {0, 0.75},
+	{0, 4}, {0, 0.8}, {0.01, 3}, {0.5, 5},
+	{0.01, 0.2}, {0.01, 0.9}, {0.01, 2}, {0, 1}, {1, 6},
+}
+
+// The average log loss of the model's predictions, and the number of predictions
+func (w FSRSParameters) loss(histories [][]ReviewEvent) (float64, int) {
+	total, count := 0.0, 0
+	for _, reviews := range histories {
+		if len(reviews) == 0 {
+			continue
+		}
+		m := w.initialMemory(reviews[0].Rating)
+		for i := 1; i < len(reviews); i++ {
+			elapsed := max(reviews[i].ReviewedAt.Sub(reviews[i-1].ReviewedAt).Hours()/24, 0)
+			r := min(max(retrievability(elapsed, m.Stability), 1e-4), 1-1e-4)
+			if reviews[i].Rating == ratingAgain {
+				total -= math.Log(1 - r)
+			} else {
+				total -= math.Log(r)
+			}
+			count++
+			m = w.nextMemory(m, elapsed, reviews[i].Rating)
+		}
+	}
+
+	if count == 0 {
+		return 0, 0
+	}
+	return total / float64(count), count
+}
+
+// Parameters are optimized after being scaled to lie between 0 and 1,
+// so that the same learning rate suits all of them
+func normalizeParameters(w FSRSParameters) []float64 {
+	x := make([]float64, len(w))
+	for i, bounds := range parameterBounds {
+		x[i] = (min(max(w[i], bounds[0]), bounds[1]) - bounds[0]) / (bounds[1] - bounds[0])
+	}
+	return x
+}
+
+func denormalizeParameters(x []float64) FSRSParameters {
+	w := make(FSRSParameters, len(x))
+	for i, bounds := range parameterBounds {
+		w[i] = bounds[0] + x[i]*(bounds[1]-bounds[0])
+	}
+	return w
+}
+
+// Take an evenly spaced sample of the histories
+func sampleHistories(histories [][]ReviewEvent, size int) [][]ReviewEvent {
+	if len(histories) <= size {
+		return histories
+	}
+
+	sample := make([][]ReviewEvent, size)
+	for i := range sample {
+		sample[i] = histories[i*len(histories)/size]
+	}
+	return sample
+}
+
+// Fit parameters to the review histories, starting from the default
+// parameters. Returns the best parameters found, their loss and
+// the loss of the default parameters
+func fitParameters(histories [][]ReviewEvent) (FSRSParameters, float64, float64) {
+	histories = sampleHistories(histories, maxTrainingCards)
+	const beta1, beta2, epsilon = 0.9, 0.999, 1e-8
+
+	x := normalizeParameters(defaultParameters)
+	m := make([]float64, len(x))
+	v := make([]float64, len(x))
+	grad := make([]float64, len(x))
+
+	baseline, _ := defaultParameters.loss(histories)
+	best, bestLoss := defaultParameters, baseline
+	for step := 1; step <= optimizerSteps; step++ {
+		loss, _ := denormalizeParameters(x).loss(histories)
+		if loss < bestLoss {
+			best, bestLoss = denormalizeParameters(x), loss
+		}
+
+		for i := range x {
+			original := x[i]
+			// Step backwards at the upper bound to stay inside the range
+			delta := optimizerDelta
+			if original+delta > 1 {
+				delta = -delta
+			}
+
+			x[i] = original + delta
+			shifted, _ := denormalizeParameters(x).loss(histories)
+			grad[i] = (shifted - loss) / delta
+			x[i] = original
+		}
+
+		for i := range x {
+			m[i] = beta1*m[i] + (1-beta1)*grad[i]
+			v[i] = beta2*v[i] + (1-beta2)*grad[i]*grad[i]
+			mHat := m[i] / (1 - math.Pow(beta1, float64(step)))
+			vHat := v[i] / (1 - math.Pow(beta2, float64(step)))
+			x[i] = min(max(x[i]-optimizerLearningRate*mHat/(math.Sqrt(vHat)+epsilon), 0), 1)
+		}
+	}
+
+	loss, _ := denormalizeParameters(x).loss(histories)
+	if loss < bestLoss {
+		best, bestLoss = denormalizeParameters(x), loss
+	}
+	return best, bestLoss, baseline
+}
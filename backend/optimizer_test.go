@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Build a card's review history from ratings given a number of days apart
+func reviewHistory(start time.Time, days []float64, ratings []int) []ReviewEvent {
+	reviews := make([]ReviewEvent, len(ratings))
+	at := start
+	for i, rating := range ratings {
+		if i > 0 {
+			at = at.Add(time.Duration(days[i-1] * float64(24*time.Hour)))
+		}
+		reviews[i] = ReviewEvent{Rating: rating, ReviewedAt: at}
+	}
+	return reviews
+}
+
+func TestLoss(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		histories   [][]ReviewEvent
+		predictions int
+	}{
+		{"no histories", nil, 0},
+		{"an empty history", [][]ReviewEvent{{}}, 0},
+		{"only first reviews", [][]ReviewEvent{
+			reviewHistory(start, nil, []int{ratingGood}),
+			reviewHistory(start, nil, []int{ratingAgain}),
+		}, 0},
+		{"several reviews", [][]ReviewEvent{
+			reviewHistory(start, []float64{1, 3}, []int{ratingGood, ratingGood, ratingAgain}),
+			reviewHistory(start, []float64{2}, []int{ratingEasy, ratingHard}),
+		}, 3},
+	}
+
+	for _, test := range tests {
+		loss, predictions := defaultParameters.loss(test.histories)
+		if predictions != test.predictions {
+			t.Errorf("%s: got %d predictions, expected %d", test.name, predictions, test.predictions)
+		}
+		if math.IsNaN(loss) || loss < 0 || (predictions == 0 && loss != 0) {
+			t.Errorf("%s: got an invalid loss of %f", test.name, loss)
+		}
+	}
+}
+
+func TestNormalizeParameters(t *testing.T) {
+	x := normalizeParameters(defaultParameters)
+	for i, value := range x {
+		if value < 0 || value > 1 {
+			t.Errorf("parameter %d normalized to %f, outside of 0 to 1", i, value)
+		}
+	}
+
+	w := denormalizeParameters(x)
+	for i := range w {
+		if math.Abs(w[i]-defaultParameters[i]) > 1e-9 {
+			t.Errorf("parameter %d changed from %f to %f", i, defaultParameters[i], w[i])
+		}
+	}
+
+	// Out of range parameters are clamped to their bounds
+	outOfRange := slices.Clone(defaultParameters)
+	outOfRange[0], outOfRange[7] = -5, 2
+	x = normalizeParameters(outOfRange)
+	if x[0] != 0 || x[7] != 1 {
+		t.Errorf("expected parameters to be clamped, got %f and %f", x[0], x[7])
+	}
+}
+
+func TestSampleHistories(t *testing.T) {
+	histories := make([][]ReviewEvent, 10)
+	for i := range histories {
+		histories[i] = make([]ReviewEvent, i+1)
+	}
+
+	if sample := sampleHistories(histories, 20); len(sample) != 10 {
+		t.Errorf("small histories shouldn't be sampled, got %d", len(sample))
+	}
+
+	sample := sampleHistories(histories, 5)
+	if len(sample) != 5 {
+		t.Fatalf("expected a sample of 5, got %d", len(sample))
+	}
+	for i, reviews := range sample {
+		if len(reviews) != 2*i+1 {
+			t.Errorf("sample %d should be history %d", i, 2*i)
+		}
+	}
+}
+
+func TestFitParametersWithoutReviews(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, histories := range [][][]ReviewEvent{
+		nil,
+		{reviewHistory(start, nil, []int{ratingGood})},
+	} {
+		fitted, loss, baseline := fitParameters(histories)
+		if loss != 0 || baseline != 0 {
+			t.Errorf("expected no loss, got %f and %f", loss, baseline)
+		}
+		// There's nothing to improve on, so the defaults are kept
+		if !slices.Equal(fitted, defaultParameters) {
+			t.Errorf("expected the default parameters, got %v", fitted)
+		}
+	}
+}
+
+func TestFitParameters(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A user who forgets everything after a day, which the
+	// default parameters think is very unlikely
+	histories := [][]ReviewEvent{}
+	for i := 0; i < 50; i++ {
+		ratings := []int{ratingGood, ratingAgain, ratingAgain, ratingAgain}
+		histories = append(histories, reviewHistory(start, []float64{2, 2, 2}, ratings))
+	}
+
+	fitted, loss, baseline := fitParameters(histories)
+	if loss >= baseline {
+		t.Errorf("expected the loss to improve on %f, got %f", baseline, loss)
+	}
+	if recomputed, _ := fitted.loss(histories); math.Abs(recomputed-loss) > 1e-9 {
+		t.Errorf("the fitted parameters have a loss of %f, not %f", recomputed, loss)
+	}
+	for i, bounds := range parameterBounds {
+		if fitted[i] < bounds[0] || fitted[i] > bounds[1] {
+			t.Errorf("parameter %d is %f, outside of its bounds", i, fitted[i])
+		}
+	}
+}
+
+func TestFitParametersNeverWorse(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	histories := [][]ReviewEvent{
+		reviewHistory(start, []float64{1, 3, 8}, []int{ratingGood, ratingGood, ratingGood, ratingGood}),
+		reviewHistory(start, []float64{1, 1}, []int{ratingAgain, ratingGood, ratingEasy}),
+	}
+
+	_, loss, baseline := fitParameters(histories)
+	if loss > baseline {
+		t.Errorf("the fitted loss %f is worse than the default loss %f", loss, baseline)
+	}
+}
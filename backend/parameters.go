@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// The states of a user's parameter optimization
+const (
+	optimizationPending    = "pending"
+	optimizationRunning    = "running"
+	optimizationOptimized  = "optimized"
+	optimizationNoGain     = "noImprovement"
+	optimizationNotEnough  = "insufficientData"
+	optimizationNotStarted = "notStarted"
+)
+
+const (
+	// The number of predictions needed to fit parameters reliably
+	minOptimizationReviews = 400
+	// Parameters are optimized again after this many new reviews
+	reoptimizationReviews = 1000
+	// Optimizations that have been running for this long are assumed to have crashed
+	optimizationTimeout = time.Hour
+	optimizationsPerRun = 20
+)
+
+type ParameterStatus struct {
+	Status string `json:"status"`
+	// The parameters used to schedule the user's cards
+	Parameters   FSRSParameters `json:"parameters"`
+	Personalized bool           `json:"personalized"`
+	// The log loss of the fitted and default parameters on the user's reviews
+	Loss         *float64   `json:"loss"`
+	BaselineLoss *float64   `json:"baselineLoss"`
+	ReviewCount  int        `json:"reviewCount"`
+	UpdatedAt    *time.Time `json:"updatedAt"`
+	OptimizedAt  *time.Time `json:"optimizedAt"`
+}
+
+// Get the parameters used to schedule the user's cards, which
+// are the default parameters until they've been optimized
+func getParameters(tx pgx.Tx, userId string) (FSRSParameters, error) {
+	var params []float64
+	str := `
+		select Parameters from UserParameters
+		where UserID = $1 and Parameters is not null`
+	err := tx.QueryRow(context.Background(), str, userId).Scan(&params)
+	if err == pgx.ErrNoRows || len(params) != len(defaultParameters) {
+		return defaultParameters, nil
+	}
+	return FSRSParameters(params), err
+}
+
+func (db *Database) getParameterStatus(userId string) (ParameterStatus, error) {
+	var params []float64
+	status := ParameterStatus{}
+	str := `
+		select Status, Parameters, Loss, BaselineLoss, ReviewCount, UpdatedAt, OptimizedAt
+		from UserParameters where UserID = $1`
+	err := db.pool.QueryRow(context.Background(), str, userId).Scan(
+		&status.Status, &params, &status.Loss, &status.BaselineLoss,
+		&status.ReviewCount, &status.UpdatedAt, &status.OptimizedAt,
+	)
+	if err == pgx.ErrNoRows {
+		status.Status = optimizationNotStarted
+	} else if err != nil {
+		return ParameterStatus{}, err
+	}
+
+	status.Personalized = len(params) == len(defaultParameters)
+	status.Parameters = defaultParameters
+	if status.Personalized {
+		status.Parameters = FSRSParameters(params)
+	}
+	return status, nil
+}
+
+// Queue an optimization of the user's parameters, unless one is already queued
+func (db *Database) requestOptimization(userId string) error {
+	str := `
+		insert into UserParameters (UserID, Status) values ($1, $2)
+		on conflict (UserID) do update set Status = $2, UpdatedAt = now()
+		where UserParameters.Status not in ($2, $3)`
+	_, err := db.pool.Exec(
+		context.Background(), str, userId, optimizationPending, optimizationRunning)
+	return err
+}
+
+// Queue optimizations for users with enough reviews who haven't had their
+// parameters optimized yet, or who reviewed a lot since the last time
+func (db *Database) queueOptimizations() error {
+	str := `
+		insert into UserParameters (UserID, Status)
+		select r.UserID, $1 from Reviews r
+		left join UserParameters p on p.UserID = r.UserID
+		where p.UserID is null or p.Status not in ($1, $2)
+		group by r.UserID, p.UserID, p.ReviewCount
+		having count(*) >= case
+			when p.UserID is null then $3 else p.ReviewCount + $4
+		end
+		on conflict (UserID) do update set Status = $1, UpdatedAt = now()`
+	_, err := db.pool.Exec(
+		context.Background(), str, optimizationPending, optimizationRunning,
+		minOptimizationReviews, reoptimizationReviews,
+	)
+	return err
+}
+
+// Take the oldest queued optimization, so that
+// multiple servers never run the same one
+func (db *Database) claimOptimization() (string, error) {
+	var userId string
+	str := `
+		update UserParameters set Status = $1, UpdatedAt = now()
+		where UserID = (
+			select UserID from UserParameters
+			where Status = $2 or (Status = $1 and UpdatedAt < $3)
+			order by UpdatedAt limit 1
+			for update skip locked
+		)
+		returning UserID`
+	err := db.pool.QueryRow(
+		context.Background(), str, optimizationRunning, optimizationPending,
+		time.Now().Add(-optimizationTimeout),
+	).Scan(&userId)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return userId, err
+}
+
+// Get the reviews of each of the user's cards, oldest first
+func (db *Database) getReviewHistories(userId string) (map[int][]ReviewEvent, int, error) {
+	str := `
+		select CardID, Rating, ReviewedAt from Reviews
+		where UserID = $1 order by CardID, ReviewedAt, ID`
+	rows, err := db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	histories := map[int][]ReviewEvent{}
+	count := 0
+	for rows.Next() {
+		var cardId int
+		var r ReviewEvent
+		if err := rows.Scan(&cardId, &r.Rating, &r.ReviewedAt); err != nil {
+			return nil, 0, err
+		}
+		histories[cardId] = append(histories[cardId], r)
+		count++
+	}
+
+	return histories, count, rows.Err()
+}
+
+// Fit the user's parameters to their review history. The fitted parameters
+// are only used if they predict the user's reviews better than the defaults,
+// in which case all of the user's cards are rescheduled with them
+func (db *Database) optimizeUserParameters(userId string) error {
+	histories, reviewCount, err := db.getReviewHistories(userId)
+	if err != nil {
+		return err
+	}
+
+	// Sorted so that the same cards get sampled every time
+	cardIds := slices.Sorted(maps.Keys(histories))
+	samples := make([][]ReviewEvent, len(cardIds))
+	for i, cardId := range cardIds {
+		samples[i] = histories[cardId]
+	}
+
+	// Fitting takes a while, so it's done before starting the transaction
+	status := optimizationOptimized
+	var params FSRSParameters
+	var loss, baseline *float64
+	if _, predictions := defaultParameters.loss(samples); predictions < minOptimizationReviews {
+		status = optimizationNotEnough
+	} else {
+		fitted, fittedLoss, defaultLoss := fitParameters(samples)
+		loss, baseline = &fittedLoss, &defaultLoss
+		if fittedLoss >= defaultLoss {
+			status = optimizationNoGain
+		} else {
+			params = fitted
+		}
+	}
+
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	// Users without enough reviews keep whatever parameters they had,
+	// otherwise the defaults are used unless the fitted parameters are better
+	str := `
+		update UserParameters set Status = $2, ReviewCount = $3,
+			Parameters = case when $2 = $7 then Parameters else $4 end,
+			Loss = $5, BaselineLoss = $6, UpdatedAt = now(), OptimizedAt = now()
+		where UserID = $1`
+	_, err = tx.Exec(
+		context.Background(), str, userId, status, reviewCount,
+		[]float64(params), loss, baseline, optimizationNotEnough,
+	)
+	if err != nil {
+		return err
+	}
+
+	if status != optimizationOptimized {
+		return tx.Commit(context.Background())
+	}
+
+	// Cards that were reviewed in the meantime were already rescheduled
+	stabilities := make([]float64, len(samples))
+	difficulties := make([]float64, len(samples))
+	lastReviews := make([]time.Time, len(samples))
+	dues := make([]time.Time, len(samples))
+	for i, reviews := range samples {
+		s := params.schedule(reviews, time.Time{})
+		stabilities[i], difficulties[i] = s.Stability, s.Difficulty
+		lastReviews[i], dues[i] = *s.LastReview, s.Due
+	}
+
+	str = `
+		update Flashcards f set Stability = u.Stability, Difficulty = u.Difficulty,
+			Due = u.Due, ScheduledAt = now()
+		from unnest($1::integer[], $2::float8[], $3::float8[], $4::timestamptz[], $5::timestamptz[])
+			as u(ID, Stability, Difficulty, LastReview, Due)
+		where f.ID = u.ID and f.LastReview = u.LastReview`
+	_, err = tx.Exec(
+		context.Background(), str, cardIds, stabilities, difficulties, lastReviews, dues)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Run the queued optimizations
+func (db *Database) optimizeParameters() error {
+	if err := db.queueOptimizations(); err != nil {
+		return err
+	}
+
+	for range optimizationsPerRun {
+		userId, err := db.claimOptimization()
+		if err != nil {
+			return err
+		}
+		if userId == "" {
+			return nil
+		}
+
+		if err := db.optimizeUserParameters(userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) GetParameters(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	status, err := app.db.getParameterStatus(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, status)
+}
+
+// Queue an optimization of the user's parameters. It runs in the background,
+// so clients should poll the parameters to find out when it's done
+func (app *App) OptimizeParameters(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	if err := app.db.requestOptimization(userId); err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	status, err := app.db.getParameterStatus(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, status)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every request takes a token from a bucket, and buckets refill at a steady
+// rate, so clients can burst up to a limit and are then slowed down to the
+// refill rate. Requests are counted per user when they're authenticated,
+// and per ip address otherwise.
+//
+// Limits are written as <requests>/<window>, like 60/m or 10/30s. Routes
+// share the RATE_LIMIT_DEFAULT limit (120/m by default) unless they're given
+// their own in RATE_LIMITS, which is a comma separated list of
+// <method> <route>=<limit>, like "POST /generate=10/m,GET /search=off".
+// Routes are written like they're registered, so "POST /deck/:id/publish".
+//
+// RATE_LIMITER picks where buckets are kept: in memory (the default), or in
+// postgres, which is needed when more than one instance serves the app
+const defaultRateLimit = "120/m"
+
+var defaultRouteLimits = map[string]string{
+	"POST /authenticate":       "30/m",
+	"POST /generate":           "10/m",
+	"POST /deck":               "10/m",
+	"POST /card/:id/explain":   "30/m",
+	"POST /auth/reset/request": "5/m",
+	"POST /auth/verify/resend": "5/m",
+}
+
+const (
+	// Buckets that haven't been used in a while are full again,
+	// so they can be forgotten
+	bucketMemory = 24 * time.Hour
+	// Once there are this many buckets in memory, the least recently used
+	// one is dropped for every new one. That client starts over with a full
+	// bucket, which only happens when many clients show up at once
+	maxMemoryBuckets  = 100000
+	rateLimitDisabled = "off"
+)
+
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// Tokens added back to the bucket every second
+func (l RateLimit) rate() float64 { return float64(l.Requests) / l.Window.Seconds() }
+
+type RateLimitResult struct {
+	Allowed bool
+	// Tokens left in the bucket
+	Remaining int
+	// How long until the bucket is full again
+	ResetAfter time.Duration
+	// How long until a request would be allowed
+	RetryAfter time.Duration
+}
+
+type RateLimiter interface {
+	take(key string, limit RateLimit) (RateLimitResult, error)
+	prune() error
+}
+
+type RateLimits struct {
+	fallback RateLimit
+	// Routes without a limit aren't rate limited
+	routes map[string]*RateLimit
+}
+
+var ErrRateLimited error = fmt.Errorf("rate limit exceeded, slow down")
+
+func parseRateLimit(value string) (RateLimit, error) {
+	count, window, found := strings.Cut(strings.TrimSpace(value), "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("rate limit %q should be <requests>/<window>", value)
+	}
+
+	requests, err := strconv.Atoi(count)
+	if err != nil || requests < 1 {
+		return RateLimit{}, fmt.Errorf("rate limit %q should allow at least 1 request", value)
+	}
+
+	if window == "s" || window == "m" || window == "h" || window == "d" {
+		window = "1" + window
+	}
+	var duration time.Duration
+	if days, found := strings.CutSuffix(window, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return RateLimit{}, fmt.Errorf("rate limit %q has an invalid window", value)
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	} else if duration, err = time.ParseDuration(window); err != nil {
+		return RateLimit{}, fmt.Errorf("rate limit %q has an invalid window", value)
+	}
+	if duration < time.Second {
+		return RateLimit{}, fmt.Errorf("rate limit %q has a window under a second", value)
+	}
+
+	return RateLimit{requests, duration}, nil
+}
+
+func loadRateLimits(secrets map[string]string) (RateLimits, error) {
+	fallback := defaultRateLimit
+	if value := secrets["RATE_LIMIT_DEFAULT"]; value != "" {
+		fallback = value
+	}
+	limit, err := parseRateLimit(fallback)
+	if err != nil {
+		return RateLimits{}, err
+	}
+	limits := RateLimits{limit, map[string]*RateLimit{}}
+
+	routes := map[string]string{}
+	for route, value := range defaultRouteLimits {
+		routes[route] = value
+	}
+	for _, entry := range strings.Split(secrets["RATE_LIMITS"], ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		route, value, found := strings.Cut(entry, "=")
+		if !found {
+			return RateLimits{}, fmt.Errorf("RATE_LIMITS entries should be <method> <route>=<limit>")
+		}
+		method, path, found := strings.Cut(strings.TrimSpace(route), " ")
+		if !found {
+			return RateLimits{}, fmt.Errorf("%q in RATE_LIMITS is missing a method", route)
+		}
+		routes[strings.ToUpper(method)+" "+strings.TrimSpace(path)] = strings.TrimSpace(value)
+	}
+
+	for route, value := range routes {
+		if value == rateLimitDisabled {
+			limits.routes[route] = nil
+			continue
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return RateLimits{}, err
+		}
+		limits.routes[route] = &limit
+	}
+	return limits, nil
+}
+
+// Get the limit for a route, and the bucket name requests are counted under.
+// Returns nil when the route isn't rate limited
+func (l RateLimits) forRoute(route string) (*RateLimit, string) {
+	if limit, exists := l.routes[route]; exists {
+		return limit, route
+	}
+	return &l.fallback, "default"
+}
+
+func loadRateLimiter(secrets map[string]string, db Database) (RateLimiter, error) {
+	switch kind := secrets["RATE_LIMITER"]; kind {
+	case "", "memory":
+		return NewMemoryRateLimiter(), nil
+	case "postgres":
+		return postgresRateLimiter{db}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q", kind)
+	}
+}
+
+// Work out how the bucket looks after trying to take a token from it
+func takeToken(tokens float64, limit RateLimit) (float64, RateLimitResult) {
+	result := RateLimitResult{Allowed: tokens >= 1}
+	if result.Allowed {
+		tokens -= 1
+	} else {
+		wait := (1 - tokens) / limit.rate()
+		result.RetryAfter = time.Duration(wait * float64(time.Second))
+	}
+
+	result.Remaining = int(math.Floor(tokens))
+	refill := (float64(limit.Requests) - tokens) / limit.rate()
+	result.ResetAfter = time.Duration(refill * float64(time.Second))
+	return tokens, result
+}
+
+type tokenBucket struct {
+	key       string
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// Buckets are kept in a list ordered from the most to the least recently used
+type MemoryRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	recent  *list.List
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*list.Element{}, recent: list.New()}
+}
+
+func (m *MemoryRateLimiter) take(key string, limit RateLimit) (RateLimitResult, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	capacity := float64(limit.Requests)
+	var bucket *tokenBucket
+	if element, exists := m.buckets[key]; exists {
+		m.recent.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+	} else {
+		if m.recent.Len() >= maxMemoryBuckets {
+			m.remove(m.recent.Back())
+		}
+		bucket = &tokenBucket{key: key, tokens: capacity, updatedAt: now}
+		m.buckets[key] = m.recent.PushFront(bucket)
+	}
+
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	tokens := min(capacity, bucket.tokens+elapsed*limit.rate())
+	tokens, result := takeToken(tokens, limit)
+
+	bucket.tokens = tokens
+	bucket.updatedAt = now
+	bucket.fullAt = now.Add(result.ResetAfter)
+	return result, nil
+}
+
+func (m *MemoryRateLimiter) remove(element *list.Element) {
+	bucket := m.recent.Remove(element).(*tokenBucket)
+	delete(m.buckets, bucket.key)
+}
+
+// Drop the buckets that have filled up again
+func (m *MemoryRateLimiter) prune() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for element := m.recent.Back(); element != nil; {
+		previous := element.Prev()
+		if now.After(element.Value.(*tokenBucket).fullAt) {
+			m.remove(element)
+		}
+		element = previous
+	}
+	return nil
+}
+
+// Buckets are shared between instances through the database. Each request
+// refills and takes from its bucket in a single statement, so concurrent
+// requests can't take the same token
+type postgresRateLimiter struct {
+	db Database
+}
+
+func (p postgresRateLimiter) take(key string, limit RateLimit) (RateLimitResult, error) {
+	var tokens float64
+	var allowed bool
+	str := `
+		insert into RateLimitBuckets as b (Key, Tokens, Allowed, UpdatedAt)
+		values ($1, $2::float8 - 1, true, now())
+		on conflict (Key) do update set
+			Tokens = case
+				when least($2::float8, b.Tokens + extract(epoch from now() - b.UpdatedAt) * $3::float8) >= 1
+				then least($2::float8, b.Tokens + extract(epoch from now() - b.UpdatedAt) * $3::float8) - 1
+				else least($2::float8, b.Tokens + extract(epoch from now() - b.UpdatedAt) * $3::float8)
+			end,
+			Allowed = least($2::float8, b.Tokens + extract(epoch from now() - b.UpdatedAt) * $3::float8) >= 1,
+			UpdatedAt = now()
+		returning Tokens, Allowed`
+	err := p.db.pool.QueryRow(
+		context.Background(), str, key, float64(limit.Requests), limit.rate(),
+	).Scan(&tokens, &allowed)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	// The token was already taken, so work out the result from before
+	if allowed {
+		tokens += 1
+	}
+	_, result := takeToken(tokens, limit)
+	return result, nil
+}
+
+func (p postgresRateLimiter) prune() error {
+	str := "delete from RateLimitBuckets where UpdatedAt < $1"
+	_, err := p.db.pool.Exec(context.Background(), str, time.Now().Add(-bucketMemory))
+	return err
+}
+
+// Count the request against its route's limit and refuse it once the
+// client has used up its bucket. Limiter errors let the request through,
+// since an unavailable limiter shouldn't take the whole api down
+func (app *App) rateLimit(ctx *gin.Context) {
+	route := ctx.Request.Method + " " + ctx.FullPath()
+	limit, bucket := app.limits.forRoute(route)
+	if limit == nil {
+		ctx.Next()
+		return
+	}
+
+	client := "ip:" + ctx.ClientIP()
+	if ctx.GetHeader("Authorization") != "" {
+		if userId, err := app.getUserID(ctx); err == nil {
+			client = "user:" + userId
+		}
+	}
+
+	result, err := app.limiter.take(bucket+"|"+client, *limit)
+	if err != nil {
+		log.Printf("rate limiting %s failed: %v", client, err)
+		ctx.Next()
+		return
+	}
+
+	seconds := func(d time.Duration) string {
+		return strconv.Itoa(int(math.Ceil(d.Seconds())))
+	}
+	ctx.Header("RateLimit-Limit", strconv.Itoa(limit.Requests))
+	ctx.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	ctx.Header("RateLimit-Reset", seconds(result.ResetAfter))
+	ctx.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%s", limit.Requests, seconds(limit.Window)))
+
+	if !result.Allowed {
+		ctx.Header("Retry-After", seconds(result.RetryAfter))
+		handleResponse(ctx, http.StatusTooManyRequests, ErrRateLimited.Error())
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
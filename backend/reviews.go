@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Every review is kept in a log. A card's schedule is always computed by
+// replaying its whole log in chronological order, so reviews made offline
+// that arrive late or out of order still produce the same schedule
+func recordReview(
+	tx pgx.Tx, userId string, cardId, sessionId, rating, elapsedMs int,
+	reviewedAt time.Time,
+) (Schedule, error) {
+	str := `
+		insert into Reviews (UserID, CardID, SessionID, Rating, ElapsedMs, ReviewedAt)
+		values ($1, $2, $3, $4, $5, $6)`
+	_, err := tx.Exec(
+		context.Background(), str, userId, cardId, nullableID(sessionId),
+		rating, elapsedMs, reviewedAt,
+	)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	params, err := getParameters(tx, userId)
+	if err != nil {
+		return Schedule{}, err
+	}
+	return rescheduleCard(tx, cardId, params)
+}
+
+func rescheduleCard(tx pgx.Tx, cardId int, params FSRSParameters) (Schedule, error) {
+	var created time.Time
+	str := "select CreatedAt from Flashcards where ID = $1"
+	if err := tx.QueryRow(context.Background(), str, cardId).Scan(&created); err != nil {
+		return Schedule{}, err
+	}
+
+	str = "select Rating, ReviewedAt from Reviews where CardID = $1 order by ReviewedAt, ID"
+	rows, err := tx.Query(context.Background(), str, cardId)
+	if err != nil {
+		return Schedule{}, err
+	}
+	defer rows.Close()
+
+	reviews := []ReviewEvent{}
+	for rows.Next() {
+		var r ReviewEvent
+		if err := rows.Scan(&r.Rating, &r.ReviewedAt); err != nil {
+			return Schedule{}, err
+		}
+		reviews = append(reviews, r)
+	}
+	if err := rows.Err(); err != nil {
+		return Schedule{}, err
+	}
+
+	s := params.schedule(reviews, created)
+	str = `
+		update Flashcards set Stability = $2, Difficulty = $3, Reps = $4,
+			Lapses = $5, LastReview = $6, Due = $7, ScheduledAt = now()
+		where ID = $1`
+	_, err = tx.Exec(
+		context.Background(), str, cardId,
+		s.Stability, s.Difficulty, s.Reps, s.Lapses, s.LastReview, s.Due,
+	)
+	return s, err
+}
+
+func (db *Database) reviewCard(
+	userId string, cardId, sessionId, rating, elapsedMs int, reviewedAt time.Time,
+) (Schedule, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return Schedule{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if sessionId != 0 {
+		if err := checkStudySession(tx, userId, sessionId); err != nil {
+			return Schedule{}, err
+		}
+	}
+
+	str := `
+		select f.ID from Flashcards f join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and f.ID = $2
+		and d.DeletedAt is null and f.DeletedAt is null
+		for update of f`
+	err = tx.QueryRow(context.Background(), str, userId, cardId).Scan(&cardId)
+	if err == pgx.ErrNoRows {
+		return Schedule{}, ErrCardNotFound
+	} else if err != nil {
+		return Schedule{}, err
+	}
+
+	schedule, err := recordReview(
+		tx, userId, cardId, sessionId, rating, elapsedMs, reviewedAt)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	return schedule, tx.Commit(context.Background())
+}
+
+type ReviewData struct {
+	CardID    int `json:"cardId" binding:"required"`
+	Rating    int `json:"rating" binding:"required,min=1,max=4"`
+	ElapsedMs int `json:"elapsedMs" binding:"min=0"`
+	SessionID int `json:"sessionId"`
+	// When the card was reviewed, which defaults to now
+	ReviewedAt *time.Time `json:"reviewedAt"`
+}
+
+// Record a review of a card and respond with its new schedule
+func (app *App) ReviewCard(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data ReviewData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	reviewedAt := time.Now()
+	if data.ReviewedAt != nil && data.ReviewedAt.Before(reviewedAt) {
+		reviewedAt = *data.ReviewedAt
+	}
+
+	schedule, err := app.db.reviewCard(
+		userId, data.CardID, data.SessionID, data.Rating, data.ElapsedMs, reviewedAt)
+	if err == ErrCardNotFound || err == ErrSessionNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err == ErrSessionEnded {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, schedule)
+}
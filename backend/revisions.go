@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// The different kinds of changes recorded in a card's history
+const (
+	revisionGenerated = "generated" // Created by the llm along with its deck
+	revisionCreated   = "created"
+	revisionEdited    = "edited"
+	revisionDeleted   = "deleted"
+	revisionRestored  = "restored"
+	revisionReverted  = "reverted"
+)
+
+type CardText struct {
+	Front string `json:"front"`
+	Back  string `json:"back"`
+}
+
+// A change made to a card. Before is null when the card was
+// created and after is null when the card was deleted
+type Revision struct {
+	ID        int       `json:"id"`
+	CardID    int       `json:"cardId"`
+	UserID    string    `json:"userId"`
+	Action    string    `json:"action"`
+	Before    *CardText `json:"before"`
+	After     *CardText `json:"after"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func recordRevision(
+	tx pgx.Tx, userId string, cardId int, action string, before, after *Card,
+) error {
+	var frontBefore, backBefore, frontAfter, backAfter *string
+	if before != nil {
+		frontBefore, backBefore = &before.Front, &before.Back
+	}
+	if after != nil {
+		frontAfter, backAfter = &after.Front, &after.Back
+	}
+
+	str := `
+		insert into CardRevisions
+			(CardID, UserID, Action, FrontBefore, BackBefore, FrontAfter, BackAfter)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := tx.Exec(
+		context.Background(), str, cardId, userId, action,
+		frontBefore, backBefore, frontAfter, backAfter,
+	)
+	return err
+}
+
+// Get the history of one of the user's cards, oldest change first.
+// The history of cards in the trash is available too
+func (db *Database) getCardHistory(userId string, cardId int) ([]Revision, error) {
+	str := `
+		select r.ID, r.UserID, r.Action,
+			r.FrontBefore, r.BackBefore, r.FrontAfter, r.BackAfter, r.CreatedAt
+		from CardRevisions r
+		join Flashcards f on f.ID = r.CardID
+		join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and r.CardID = $2
+		order by r.ID`
+	rows, err := db.pool.Query(context.Background(), str, userId, cardId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		r := Revision{CardID: cardId}
+		var frontBefore, backBefore, frontAfter, backAfter *string
+		err := rows.Scan(
+			&r.ID, &r.UserID, &r.Action,
+			&frontBefore, &backBefore, &frontAfter, &backAfter, &r.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if frontBefore != nil {
+			r.Before = &CardText{Front: *frontBefore, Back: *backBefore}
+		}
+		if frontAfter != nil {
+			r.After = &CardText{Front: *frontAfter, Back: *backAfter}
+		}
+		revisions = append(revisions, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		return nil, ErrCardNotFound
+	}
+	return revisions, nil
+}
+
+// Set the card's text back to what it was after the revision was made
+// (or before it, for deletions). The revert is itself a new revision
+func (db *Database) revertCard(userId string, cardId, revisionId int) (Card, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return Card{}, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var deckId int
+	card := Card{ID: cardId}
+	str := `
+		select f.DeckID,
+			coalesce(r.FrontAfter, r.FrontBefore), coalesce(r.BackAfter, r.BackBefore)
+		from CardRevisions r
+		join Flashcards f on f.ID = r.CardID
+		join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and r.CardID = $2 and r.ID = $3
+		and d.DeletedAt is null and f.DeletedAt is null
+		for update of d`
+	err = tx.QueryRow(context.Background(), str, userId, cardId, revisionId).Scan(
+		&deckId, &card.Front, &card.Back)
+	if err == pgx.ErrNoRows {
+		return Card{}, ErrCardNotFound
+	} else if err != nil {
+		return Card{}, err
+	}
+
+	if _, err := editFlashcard(tx, userId, deckId, card, revisionReverted); err != nil {
+		return Card{}, err
+	}
+
+	if err := bumpDeckVersion(tx, deckId); err != nil {
+		return Card{}, err
+	}
+
+	str = "select Position, Version from Flashcards where ID = $1"
+	err = tx.QueryRow(context.Background(), str, cardId).Scan(&card.Position, &card.Version)
+	if err != nil {
+		return Card{}, err
+	}
+
+	return card, tx.Commit(context.Background())
+}
+
+func (app *App) GetCardHistory(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	cardId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	revisions, err := app.db.getCardHistory(userId, cardId)
+	if err == ErrCardNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"revisions": revisions}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+type RevertCardData struct {
+	RevisionID int `json:"revisionId" binding:"required"`
+}
+
+func (app *App) RevertCard(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	cardId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data RevertCardData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	card, err := app.db.revertCard(userId, cardId, data.RevisionID)
+	if err == ErrCardNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, card)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A card matching a search query. The front and back are snippets of
+// the card's text with the matching words highlighted in markdown bold
+type SearchResult struct {
+	CardID   int    `json:"cardId"`
+	DeckID   int    `json:"deckId"`
+	DeckName string `json:"deckName"`
+	Front    string `json:"front"`
+	Back     string `json:"back"`
+}
+
+// Search the cards in the user's decks, best matches first
+func (db *Database) searchFlashcards(
+	userId, query string, limit, offset int,
+) ([]SearchResult, error) {
+	str := `
+		with search as (select websearch_to_tsquery('english', $2::text) as query)
+		select f.ID, f.DeckID, d.Name,
+			ts_headline('english', f.Front, search.query,
+				'StartSel="**", StopSel="**", HighlightAll=true'),
+			ts_headline('english', f.Back, search.query,
+				'StartSel="**", StopSel="**", MaxFragments=2, MaxWords=20, MinWords=5')
+		from Flashcards f join Decks d on d.ID = f.DeckID, search
+		where d.UserID = $1 and d.DeletedAt is null and f.DeletedAt is null
+		and to_tsvector('english', f.Front || ' ' || f.Back) @@ search.query
+		order by ts_rank(to_tsvector('english', f.Front || ' ' || f.Back), search.query) desc,
+			f.ID
+		limit $3 offset $4`
+
+	rows, err := db.pool.Query(context.Background(), str, userId, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		err := rows.Scan(&r.CardID, &r.DeckID, &r.DeckName, &r.Front, &r.Back)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
+func (app *App) SearchFlashcards(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	query := strings.TrimSpace(ctx.Query("q"))
+	if len(query) == 0 {
+		handleResponse(ctx, http.StatusBadRequest, "empty search query")
+		return
+	}
+
+	page := parseQueryInt(ctx.Query("page"), 1, 1, 1000)
+	limit := parseQueryInt(ctx.Query("limit"), 20, 1, 100)
+
+	results, err := app.db.searchFlashcards(userId, query, limit, (page-1)*limit)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"results": results, "page": page, "limit": limit}
+	handleResponse(ctx, http.StatusOK, response)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A session is a device the user logged in on. Revoking a session revokes
+// its refresh tokens, and its access tokens are rejected from then on.
+//
+// Sessions are keyed by the jti of the access token issued at login, rather
+// than by the jti of each token. Access tokens are refreshed every few
+// minutes and each one gets a new jti, so the session's id is carried along
+// in the sid claim instead, letting every token of a device be revoked at once
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current    bool      `json:"current"`
+}
+
+var ErrSessionRevoked error = fmt.Errorf("session was revoked")
+var ErrUnknownSession error = fmt.Errorf("session not found")
+
+// Every request checks whether its session was revoked, so the answers are
+// cached for a little while. Revocations made by other servers take up to
+// this long to be noticed
+const sessionCacheTTL = 30 * time.Second
+
+const maxCachedSessions = 10000
+
+type cachedSession struct {
+	revoked   bool
+	checkedAt time.Time
+}
+
+type SessionCache struct {
+	mutex   sync.Mutex
+	entries map[string]cachedSession
+}
+
+func NewSessionCache() *SessionCache {
+	return &SessionCache{entries: map[string]cachedSession{}}
+}
+
+func (c *SessionCache) get(sessionId string) (bool, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[sessionId]
+	if !ok || time.Since(entry.checkedAt) > sessionCacheTTL {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+func (c *SessionCache) set(sessionId string, revoked bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= maxCachedSessions {
+		for id, entry := range c.entries {
+			if time.Since(entry.checkedAt) > sessionCacheTTL {
+				delete(c.entries, id)
+			}
+		}
+	}
+	c.entries[sessionId] = cachedSession{revoked, time.Now()}
+}
+
+func (db *Database) insertSession(sessionId, userId, userAgent, ip string) error {
+	str := `
+		insert into Sessions (ID, UserID, UserAgent, IPAddress)
+		values ($1, $2, $3, $4)`
+	_, err := db.pool.Exec(context.Background(), str, sessionId, userId, userAgent, ip)
+	return err
+}
+
+// Sessions that don't exist count as revoked
+func (db *Database) isSessionRevoked(userId, sessionId string) (bool, error) {
+	var revoked bool
+	str := "select RevokedAt is not null from Sessions where ID = $1 and UserID = $2"
+	err := db.pool.QueryRow(context.Background(), str, sessionId, userId).Scan(&revoked)
+	if err == pgx.ErrNoRows {
+		return true, nil
+	}
+	return revoked, err
+}
+
+func (app *App) sessionRevoked(userId, sessionId string) (bool, error) {
+	if revoked, ok := app.sessions.get(sessionId); ok {
+		return revoked, nil
+	}
+
+	revoked, err := app.db.isSessionRevoked(userId, sessionId)
+	if err != nil {
+		return false, err
+	}
+	app.sessions.set(sessionId, revoked)
+	return revoked, nil
+}
+
+// Get the sessions that can still be refreshed, most recently used first
+func (db *Database) getSessions(userId string) ([]Session, error) {
+	str := `
+		select ID, UserAgent, IPAddress, CreatedAt, LastSeenAt from Sessions s
+		where UserID = $1 and RevokedAt is null and exists (
+			select 1 from RefreshTokens r
+			where r.FamilyID = s.ID and r.UsedAt is null
+			and r.RevokedAt is null and r.ExpiresAt > now()
+		)
+		order by LastSeenAt desc`
+	rows, err := db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// Revoke one of the user's sessions along with its refresh
+// tokens, or all of them when the session id is empty
+func revokeSessions(tx pgx.Tx, userId, sessionId string) error {
+	str := `
+		update Sessions set RevokedAt = now()
+		where UserID = $1 and ($2 = '' or ID = $2) and RevokedAt is null`
+	if _, err := tx.Exec(context.Background(), str, userId, sessionId); err != nil {
+		return err
+	}
+
+	str = `
+		update RefreshTokens set RevokedAt = now()
+		where UserID = $1 and ($2 = '' or FamilyID = $2) and RevokedAt is null`
+	_, err := tx.Exec(context.Background(), str, userId, sessionId)
+	return err
+}
+
+// Revoke sessions and return the ids of the sessions that were revoked
+func (db *Database) revokeSessions(userId, sessionId string) ([]string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var ids []string
+	str := `
+		select coalesce(array_agg(ID), '{}') from Sessions
+		where UserID = $1 and ($2 = '' or ID = $2) and RevokedAt is null`
+	err = tx.QueryRow(context.Background(), str, userId, sessionId).Scan(&ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if sessionId != "" && len(ids) == 0 {
+		return nil, ErrUnknownSession
+	}
+
+	if err := revokeSessions(tx, userId, sessionId); err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit(context.Background())
+}
+
+// Refresh tokens are kept for a while after they expire, so that reuse
+// of expired tokens can still be detected. Sessions are kept as long
+// as their refresh tokens are
+func (db *Database) pruneSessions() error {
+	cutoff := time.Now().Add(-refreshTokenLifetime)
+	str := "delete from RefreshTokens where ExpiresAt < $1"
+	if _, err := db.pool.Exec(context.Background(), str, cutoff); err != nil {
+		return err
+	}
+
+	str = `
+		delete from Sessions s where LastSeenAt < $1 and not exists (
+			select 1 from RefreshTokens r where r.FamilyID = s.ID
+		)`
+	_, err := db.pool.Exec(context.Background(), str, cutoff)
+	return err
+}
+
+func (app *App) GetSessions(ctx *gin.Context) {
+	userId, sessionId, err := app.getSession(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	sessions, err := app.db.getSessions(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == sessionId
+	}
+
+	response := map[string]any{"sessions": sessions}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+// Log out of one session, or out of every session when no id is given
+func (app *App) RevokeSession(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	ids, err := app.db.revokeSessions(userId, ctx.Param("id"))
+	if err == ErrUnknownSession {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	for _, id := range ids {
+		app.sessions.set(id, true)
+	}
+
+	response := map[string]any{"revoked": ids}
+	handleResponse(ctx, http.StatusOK, response)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cards whose stability is at least this many days are considered mature
+const matureStability = 21.0
+
+type DailyReviews struct {
+	Day       string `json:"day"`
+	Reviews   int    `json:"reviews"`
+	Lapses    int    `json:"lapses"`
+	ElapsedMs int64  `json:"elapsedMs"`
+}
+
+type DeckMastery struct {
+	DeckID    int    `json:"deckId"`
+	Name      string `json:"name"`
+	CardCount int    `json:"cardCount"`
+	NewCount  int    `json:"newCount"`
+	// The number of cards that have been studied, but aren't mature yet
+	LearningCount int `json:"learningCount"`
+	MatureCount   int `json:"matureCount"`
+	// The average odds of recalling the deck's cards right now
+	Retrievability float64 `json:"retrievability"`
+}
+
+// The number of reviewed cards due on each of the upcoming
+// days, where overdue cards are counted as due today
+type ForecastDay struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+type Stats struct {
+	// The fraction of reviews of previously studied cards that weren't forgotten
+	Retention     *float64       `json:"retention"`
+	TotalReviews  int            `json:"totalReviews"`
+	Daily         []DailyReviews `json:"daily"`
+	CurrentStreak int            `json:"currentStreak"`
+	LongestStreak int            `json:"longestStreak"`
+	Decks         []DeckMastery  `json:"decks"`
+	Forecast      []ForecastDay  `json:"forecast"`
+}
+
+// Compute the user's statistics over the last few days. Days
+// are calendar days in the user's time zone
+func (db *Database) getStats(userId, timezone string, days, forecastDays int) (Stats, error) {
+	stats := Stats{Daily: []DailyReviews{}, Decks: []DeckMastery{}, Forecast: []ForecastDay{}}
+	since := time.Now().AddDate(0, 0, -days)
+
+	str := `
+		with numbered as (
+			select Rating, ReviewedAt,
+				row_number() over (partition by CardID order by ReviewedAt, ID) as N
+			from Reviews where UserID = $1
+		)
+		select (count(*) filter (where Rating > 1 and N > 1))::float8
+			/ nullif(count(*) filter (where N > 1), 0), count(*)
+		from numbered where ReviewedAt >= $2`
+	err := db.pool.QueryRow(context.Background(), str, userId, since).Scan(
+		&stats.Retention, &stats.TotalReviews)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	str = `
+		select to_char((ReviewedAt at time zone $2)::date, 'YYYY-MM-DD') as Day,
+			count(*), count(*) filter (where Rating = 1), coalesce(sum(ElapsedMs), 0)
+		from Reviews where UserID = $1 and ReviewedAt >= $3
+		group by Day order by Day`
+	rows, err := db.pool.Query(context.Background(), str, userId, timezone, since)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d DailyReviews
+		if err := rows.Scan(&d.Day, &d.Reviews, &d.Lapses, &d.ElapsedMs); err != nil {
+			return Stats{}, err
+		}
+		stats.Daily = append(stats.Daily, d)
+	}
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	// Consecutive days minus their rank are equal, which groups days into streaks.
+	// The current streak is still going as long as the user studied yesterday
+	str = `
+		with days as (
+			select distinct (ReviewedAt at time zone $2)::date as Day
+			from Reviews where UserID = $1
+		), streaks as (
+			select max(Day) as LastDay, count(*) as Length from (
+				select Day, Day - (row_number() over (order by Day))::int as Streak
+				from days
+			) grouped group by Streak
+		)
+		select coalesce(max(Length), 0), coalesce(max(Length) filter (
+			where LastDay >= (now() at time zone $2)::date - 1
+		), 0)
+		from streaks`
+	err = db.pool.QueryRow(context.Background(), str, userId, timezone).Scan(
+		&stats.LongestStreak, &stats.CurrentStreak)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	str = `
+		select d.ID, d.Name, count(f.ID),
+			count(f.ID) filter (where f.Reps = 0),
+			count(f.ID) filter (where f.Reps > 0 and f.Stability < $2),
+			count(f.ID) filter (where f.Reps > 0 and f.Stability >= $2),
+			coalesce(avg(case when f.Reps = 0 then 0 else power(
+				1 + $3 * extract(epoch from now() - f.LastReview)::float8 / 86400 / f.Stability, $4
+			) end), 0)
+		from Decks d left join Flashcards f
+		on f.DeckID = d.ID and f.DeletedAt is null
+		where d.UserID = $1 and d.DeletedAt is null
+		group by d.ID order by d.Name, d.ID`
+	rows, err = db.pool.Query(
+		context.Background(), str, userId, matureStability, fsrsFactor, fsrsDecay)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m DeckMastery
+		err := rows.Scan(
+			&m.DeckID, &m.Name, &m.CardCount, &m.NewCount,
+			&m.LearningCount, &m.MatureCount, &m.Retrievability,
+		)
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Decks = append(stats.Decks, m)
+	}
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+
+	str = `
+		with today as (select (now() at time zone $2)::date as Day)
+		select to_char(greatest((f.Due at time zone $2)::date, today.Day), 'YYYY-MM-DD') as Day,
+			count(*)
+		from Flashcards f join Decks d on d.ID = f.DeckID, today
+		where d.UserID = $1 and d.DeletedAt is null and f.DeletedAt is null
+		and f.Reps > 0 and (f.Due at time zone $2)::date < today.Day + $3::int
+		group by 1 order by 1`
+	rows, err = db.pool.Query(context.Background(), str, userId, timezone, forecastDays)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f ForecastDay
+		if err := rows.Scan(&f.Day, &f.Count); err != nil {
+			return Stats{}, err
+		}
+		stats.Forecast = append(stats.Forecast, f)
+	}
+
+	return stats, rows.Err()
+}
+
+func (app *App) GetStats(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	timezone := ctx.DefaultQuery("tz", "UTC")
+	if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+		handleResponse(ctx, http.StatusBadRequest, "invalid time zone")
+		return
+	}
+
+	days := parseQueryInt(ctx.Query("days"), 30, 1, 365)
+	forecastDays := parseQueryInt(ctx.Query("forecast"), 14, 1, 90)
+
+	stats, err := app.db.getStats(userId, timezone, days, forecastDays)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, stats)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A study session is a list of cards assembled from one or more decks.
+// Reviews made during the session are attributed to it so that it can
+// be summarized once it's over
+type SessionCard struct {
+	Card
+	DeckID int       `json:"deckId"`
+	New    bool      `json:"new"`
+	Due    time.Time `json:"due"`
+}
+
+type StudyOptions struct {
+	DeckIDs     []int
+	Filter      DeckFilter
+	NewLimit    int
+	ReviewLimit int
+	Timezone    string
+}
+
+type SessionSummary struct {
+	ID        int        `json:"id"`
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt"`
+	CardCount int        `json:"cardCount"`
+	// The number of distinct cards reviewed during the session
+	StudiedCount int `json:"studiedCount"`
+	NewCount     int `json:"newCount"`
+	Reviews      int `json:"reviews"`
+	// The number of reviews for each rating, from again to easy
+	Ratings   [4]int   `json:"ratings"`
+	Accuracy  *float64 `json:"accuracy"`
+	ElapsedMs int64    `json:"elapsedMs"`
+}
+
+var ErrSessionNotFound error = fmt.Errorf("study session not found")
+var ErrSessionEnded error = fmt.Errorf("study session has ended")
+
+// Get the number of new cards the user started studying today,
+// and the number of reviews of other cards they made today
+func getStudiedToday(tx pgx.Tx, userId, timezone string) (int, int, error) {
+	str := `
+		with numbered as (
+			select ReviewedAt,
+				row_number() over (partition by CardID order by ReviewedAt, ID) as N
+			from Reviews where UserID = $1
+		)
+		select count(*) filter (where N = 1), count(*) filter (where N > 1)
+		from numbered
+		where (ReviewedAt at time zone $2)::date = (now() at time zone $2)::date`
+	var newCount, reviewCount int
+	err := tx.QueryRow(context.Background(), str, userId, timezone).Scan(
+		&newCount, &reviewCount)
+	return newCount, reviewCount, err
+}
+
+// Get cards that are either new or due for review, oldest first
+func getStudyCards(
+	tx pgx.Tx, userId string, options StudyOptions, newCards bool, limit int,
+) ([]SessionCard, error) {
+	str := `
+		select f.ID, f.DeckID, f.Front, f.Back, f.Position, f.Version, f.Due
+		from Flashcards f join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and d.DeletedAt is null and f.DeletedAt is null
+		and (f.Reps = 0) = $2 and ($2 or f.Due <= now())
+		and (cardinality($3::integer[]) = 0 or d.ID = any($3))
+		and ($4::text = '' or exists (
+			select 1 from DeckTags dt join Tags t on t.ID = dt.TagID
+			where dt.DeckID = d.ID and t.Name = $4
+		) or exists (
+			select 1 from CardTags ct join Tags t on t.ID = ct.TagID
+			where ct.CardID = f.ID and t.Name = $4
+		))
+		and ($5::integer = 0 or d.FolderID in (
+			with recursive subtree as (
+				select ID from Folders where UserID = $1 and ID = $5
+				union all
+				select c.ID from Folders c join subtree on c.ParentID = subtree.ID
+			)
+			select ID from subtree
+		))
+		order by f.Due, f.DeckID, f.Position, f.ID
+		limit $6`
+	rows, err := tx.Query(
+		context.Background(), str, userId, newCards, options.DeckIDs,
+		options.Filter.Tag, options.Filter.FolderID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []SessionCard{}
+	for rows.Next() {
+		c := SessionCard{New: newCards}
+		err := rows.Scan(
+			&c.ID, &c.DeckID, &c.Front, &c.Back, &c.Position, &c.Version, &c.Due)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+
+	return cards, rows.Err()
+}
+
+// Spread the new cards evenly between the cards being reviewed
+func interleaveCards(reviews, newCards []SessionCard) []SessionCard {
+	cards := make([]SessionCard, 0, len(reviews)+len(newCards))
+	r, n := 0, 0
+	for r < len(reviews) || n < len(newCards) {
+		// Pick whichever kind of card is furthest behind its share of the session
+		newBehind := float64(n+1)/float64(len(newCards)) <= float64(r+1)/float64(len(reviews))
+		if n < len(newCards) && (r == len(reviews) || newBehind) {
+			cards = append(cards, newCards[n])
+			n++
+		} else {
+			cards = append(cards, reviews[r])
+			r++
+		}
+	}
+	return cards
+}
+
+// Assemble a study session, staying within the daily limits
+// of new cards and reviews
+func (db *Database) createStudySession(
+	userId string, options StudyOptions,
+) (int, []SessionCard, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	newToday, reviewsToday, err := getStudiedToday(tx, userId, options.Timezone)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reviews, err := getStudyCards(
+		tx, userId, options, false, max(options.ReviewLimit-reviewsToday, 0))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	newCards, err := getStudyCards(
+		tx, userId, options, true, max(options.NewLimit-newToday, 0))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cards := interleaveCards(reviews, newCards)
+	cardIds := make([]int, len(cards))
+	for i, card := range cards {
+		cardIds[i] = card.ID
+	}
+
+	var sessionId int
+	str := "insert into StudySessions (UserID, CardIDs) values ($1, $2) returning ID"
+	err = tx.QueryRow(context.Background(), str, userId, cardIds).Scan(&sessionId)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return sessionId, cards, tx.Commit(context.Background())
+}
+
+// Make sure reviews can be attributed to the session
+func checkStudySession(tx pgx.Tx, userId string, sessionId int) error {
+	var ended bool
+	str := "select EndedAt is not null from StudySessions where UserID = $1 and ID = $2"
+	err := tx.QueryRow(context.Background(), str, userId, sessionId).Scan(&ended)
+	if err == pgx.ErrNoRows {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if ended {
+		return ErrSessionEnded
+	}
+	return nil
+}
+
+func (db *Database) getSessionSummary(userId string, sessionId int) (SessionSummary, error) {
+	summary := SessionSummary{ID: sessionId}
+	var again, hard, good, easy int
+	str := `
+		select s.CreatedAt, s.EndedAt, cardinality(s.CardIDs),
+			count(distinct r.CardID), count(r.ID),
+			count(r.ID) filter (where not exists (
+				select 1 from Reviews p
+				where p.CardID = r.CardID and (p.ReviewedAt, p.ID) < (r.ReviewedAt, r.ID)
+			)),
+			count(r.ID) filter (where r.Rating = 1), count(r.ID) filter (where r.Rating = 2),
+			count(r.ID) filter (where r.Rating = 3), count(r.ID) filter (where r.Rating = 4),
+			coalesce(sum(r.ElapsedMs), 0)
+		from StudySessions s left join Reviews r on r.SessionID = s.ID
+		where s.UserID = $1 and s.ID = $2
+		group by s.ID`
+	err := db.pool.QueryRow(context.Background(), str, userId, sessionId).Scan(
+		&summary.StartedAt, &summary.EndedAt, &summary.CardCount,
+		&summary.StudiedCount, &summary.Reviews, &summary.NewCount,
+		&again, &hard, &good, &easy, &summary.ElapsedMs,
+	)
+	if err == pgx.ErrNoRows {
+		return SessionSummary{}, ErrSessionNotFound
+	} else if err != nil {
+		return SessionSummary{}, err
+	}
+
+	summary.Ratings = [4]int{again, hard, good, easy}
+	if summary.Reviews > 0 {
+		accuracy := float64(summary.Reviews-again) / float64(summary.Reviews)
+		summary.Accuracy = &accuracy
+	}
+	return summary, nil
+}
+
+func (db *Database) endStudySession(userId string, sessionId int) error {
+	str := `
+		update StudySessions set EndedAt = coalesce(EndedAt, now())
+		where UserID = $1 and ID = $2`
+	tag, err := db.pool.Exec(context.Background(), str, userId, sessionId)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+type StudySessionData struct {
+	DeckIDs     []int  `json:"deckIds"`
+	Tag         string `json:"tag"`
+	FolderID    int    `json:"folderId"`
+	NewLimit    *int   `json:"newLimit"`
+	ReviewLimit *int   `json:"reviewLimit"`
+	Timezone    string `json:"timezone"`
+}
+
+// Start a study session over the given decks, or all of the user's decks
+// when none are given. The new card and review limits are daily limits,
+// so cards studied earlier in the day count against them
+func (app *App) CreateStudySession(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data StudySessionData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	options := StudyOptions{
+		DeckIDs: data.DeckIDs,
+		Filter: DeckFilter{
+			Tag:      strings.ToLower(strings.TrimSpace(data.Tag)),
+			FolderID: max(data.FolderID, 0),
+		},
+		NewLimit:    20,
+		ReviewLimit: 200,
+		Timezone:    data.Timezone,
+	}
+	if options.DeckIDs == nil {
+		options.DeckIDs = []int{}
+	}
+	if data.NewLimit != nil {
+		options.NewLimit = min(max(*data.NewLimit, 0), 1000)
+	}
+	if data.ReviewLimit != nil {
+		options.ReviewLimit = min(max(*data.ReviewLimit, 0), 10000)
+	}
+
+	if options.Timezone == "" {
+		options.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(options.Timezone); err != nil || options.Timezone == "Local" {
+		handleResponse(ctx, http.StatusBadRequest, "invalid time zone")
+		return
+	}
+
+	sessionId, cards, err := app.db.createStudySession(userId, options)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	newCount := 0
+	for _, card := range cards {
+		if card.New {
+			newCount++
+		}
+	}
+
+	response := map[string]any{
+		"sessionId":   sessionId,
+		"cards":       cards,
+		"newCount":    newCount,
+		"reviewCount": len(cards) - newCount,
+	}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+func (app *App) GetStudySession(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	sessionId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	summary, err := app.db.getSessionSummary(userId, sessionId)
+	if err == ErrSessionNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, summary)
+}
+
+// End a study session and respond with its summary
+func (app *App) EndStudySession(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	sessionId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	err = app.db.endStudySession(userId, sessionId)
+	if err == ErrSessionNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	summary, err := app.db.getSessionSummary(userId, sessionId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, summary)
+}
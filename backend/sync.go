@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A change the client made while it was offline. Objects the client created
+// offline don't have server ids yet, so they're referenced by the client id
+// of the mutation that created them (DeckClientID and CardClientID)
+type SyncMutation struct {
+	ClientID     string    `json:"clientId" binding:"required"`
+	Type         string    `json:"type" binding:"required"`
+	Timestamp    time.Time `json:"timestamp" binding:"required"`
+	DeckID       int       `json:"deckId"`
+	DeckClientID string    `json:"deckClientId"`
+	CardID       int       `json:"cardId"`
+	CardClientID string    `json:"cardClientId"`
+	Name         string    `json:"name"`
+	Front        string    `json:"front"`
+	Back         string    `json:"back"`
+	Rating       int       `json:"rating"`
+	ElapsedMs    int       `json:"elapsedMs"`
+	SessionID    int       `json:"sessionId"`
+}
+
+type MutationResult struct {
+	ClientID string `json:"clientId"`
+	Status   string `json:"status"`
+	ServerID int    `json:"serverId,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type SyncedDeck struct {
+	ID int `json:"id"`
+	DeckMetadata
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type SyncedCard struct {
+	ID        int       `json:"id"`
+	DeckID    int       `json:"deckId"`
+	Front     string    `json:"front"`
+	Back      string    `json:"back"`
+	Position  int       `json:"position"`
+	Version   int       `json:"version"`
+	Due       time.Time `json:"due"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Everything that changed on the server since the client's cursor. When
+// a deck is deleted, all of its cards are deleted with it
+type SyncChanges struct {
+	Decks        []SyncedDeck `json:"decks"`
+	Cards        []SyncedCard `json:"cards"`
+	DeletedDecks []int        `json:"deletedDecks"`
+	DeletedCards []int        `json:"deletedCards"`
+}
+
+const (
+	mutationApplied  = "applied"
+	mutationRejected = "rejected"
+)
+
+var mutationTypes = []string{"createDeck", "createCard", "editCard", "deleteCard", "review"}
+
+// Changes committed by transactions that started before the cursor was taken
+// could otherwise be missed, so the returned cursor lags behind a bit.
+// Clients may get the same change twice, which is harmless since
+// they can compare versions
+const syncOverlap = 10 * time.Second
+
+// Tombstones are eventually purged, so clients whose cursor is older than
+// this need to throw away their local copy and start over from scratch
+const tombstoneRetention = 90 * 24 * time.Hour
+
+// Apply the mutations in a deterministic order: oldest first, with ties broken
+// by client id. Conflicts are resolved per card by comparing timestamps. An
+// edit only wins if it was made after the card was last changed on the server,
+// and a deletion loses to an edit made after it. Creations always succeed.
+// Mutations that were already applied (the client retried) get their
+// original result back
+func (db *Database) applyMutations(
+	userId string, mutations []SyncMutation,
+) ([]MutationResult, error) {
+	slices.SortStableFunc(mutations, func(a, b SyncMutation) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	results := []MutationResult{}
+	for _, m := range mutations {
+		result, err := getMutationResult(tx, userId, m.ClientID)
+		if err == pgx.ErrNoRows {
+			// Don't trust clocks that are ahead of ours
+			if now := time.Now(); m.Timestamp.After(now) {
+				m.Timestamp = now
+			}
+			result, err = applyMutation(tx, userId, m)
+			if err != nil {
+				return nil, err
+			}
+
+			str := `
+				insert into SyncMutations (UserID, ClientID, ServerID, Status, Reason)
+				values ($1, $2, $3, $4, $5)`
+			_, err = tx.Exec(
+				context.Background(), str, userId, result.ClientID,
+				result.ServerID, result.Status, result.Reason,
+			)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, tx.Commit(context.Background())
+}
+
+func getMutationResult(tx pgx.Tx, userId, clientId string) (MutationResult, error) {
+	result := MutationResult{ClientID: clientId}
+	str := `
+		select ServerID, Status, Reason from SyncMutations
+		where UserID = $1 and ClientID = $2`
+	err := tx.QueryRow(context.Background(), str, userId, clientId).Scan(
+		&result.ServerID, &result.Status, &result.Reason)
+	return result, err
+}
+
+// Get the server id of an object, which is either known by the client or
+// was created by a previously applied mutation
+func resolveID(tx pgx.Tx, userId string, id int, clientId string) (int, error) {
+	if clientId == "" {
+		return id, nil
+	}
+
+	result, err := getMutationResult(tx, userId, clientId)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if result.Status != mutationApplied {
+		return 0, nil
+	}
+	return result.ServerID, nil
+}
+
+func applyMutation(tx pgx.Tx, userId string, m SyncMutation) (MutationResult, error) {
+	rejected := func(reason string) (MutationResult, error) {
+		result := MutationResult{ClientID: m.ClientID, Status: mutationRejected}
+		result.Reason = reason
+		return result, nil
+	}
+	applied := func(serverId int) (MutationResult, error) {
+		result := MutationResult{ClientID: m.ClientID, Status: mutationApplied}
+		result.ServerID = serverId
+		return result, nil
+	}
+
+	if m.Type == "createDeck" {
+		if err := validateMetadata(MetadataEdit{Name: &m.Name}); err != nil {
+			return rejected(err.Error())
+		}
+
+		var deckId int
+		str := "insert into Decks (UserID, Name) values ($1, $2) returning ID"
+		err := tx.QueryRow(context.Background(), str, userId, m.Name).Scan(&deckId)
+		if err != nil {
+			return MutationResult{}, err
+		}
+		return applied(deckId)
+	}
+
+	deckId, err := resolveID(tx, userId, m.DeckID, m.DeckClientID)
+	if err != nil {
+		return MutationResult{}, err
+	}
+
+	var deckVersion int
+	str := `
+		select Version from Decks
+		where UserID = $1 and ID = $2 and DeletedAt is null for update`
+	err = tx.QueryRow(context.Background(), str, userId, deckId).Scan(&deckVersion)
+	if err == pgx.ErrNoRows {
+		return rejected("deck was deleted")
+	} else if err != nil {
+		return MutationResult{}, err
+	}
+
+	if m.Type == "createCard" {
+		cardId, err := appendFlashcard(tx, userId, deckId, m.Front, m.Back)
+		if err != nil {
+			return MutationResult{}, err
+		}
+		if err := bumpDeckVersion(tx, deckId); err != nil {
+			return MutationResult{}, err
+		}
+		return applied(cardId)
+	}
+
+	cardId, err := resolveID(tx, userId, m.CardID, m.CardClientID)
+	if err != nil {
+		return MutationResult{}, err
+	}
+
+	var updatedAt time.Time
+	str = `
+		select UpdatedAt from Flashcards
+		where DeckID = $1 and ID = $2 and DeletedAt is null for update`
+	err = tx.QueryRow(context.Background(), str, deckId, cardId).Scan(&updatedAt)
+	if err == pgx.ErrNoRows {
+		return rejected("card was deleted")
+	} else if err != nil {
+		return MutationResult{}, err
+	}
+
+	// Reviews never conflict with anything
+	if m.Type == "review" {
+		if m.Rating < ratingAgain || m.Rating > ratingEasy {
+			return rejected("invalid rating")
+		}
+
+		// The review still counts if its session can't be found or has ended,
+		// it just isn't attributed to the session
+		sessionId := m.SessionID
+		if sessionId != 0 {
+			err := checkStudySession(tx, userId, sessionId)
+			if err == ErrSessionNotFound || err == ErrSessionEnded {
+				sessionId = 0
+			} else if err != nil {
+				return MutationResult{}, err
+			}
+		}
+
+		_, err := recordReview(
+			tx, userId, cardId, sessionId, m.Rating, max(m.ElapsedMs, 0), m.Timestamp)
+		if err != nil {
+			return MutationResult{}, err
+		}
+		return applied(cardId)
+	}
+
+	if !m.Timestamp.After(updatedAt) {
+		return rejected("card was changed more recently on the server")
+	}
+
+	if m.Type == "deleteCard" {
+		_, err = deleteFlashcard(tx, userId, deckId, cardId, 0)
+	} else {
+		card := Card{ID: cardId, Front: m.Front, Back: m.Back}
+		_, err = editFlashcard(tx, userId, deckId, card, revisionEdited)
+	}
+	if err != nil {
+		return MutationResult{}, err
+	}
+
+	if err := bumpDeckVersion(tx, deckId); err != nil {
+		return MutationResult{}, err
+	}
+	return applied(cardId)
+}
+
+// Get everything that changed after the given time, along with
+// the cursor the client should use the next time it syncs
+func (db *Database) getChanges(userId string, since time.Time) (SyncChanges, time.Time, error) {
+	changes := SyncChanges{
+		Decks: []SyncedDeck{}, Cards: []SyncedCard{},
+		DeletedDecks: []int{}, DeletedCards: []int{},
+	}
+
+	var cursor time.Time
+	str := "select clock_timestamp()"
+	if err := db.pool.QueryRow(context.Background(), str).Scan(&cursor); err != nil {
+		return SyncChanges{}, cursor, err
+	}
+	cursor = cursor.Add(-syncOverlap)
+
+	str = `
+		select ID, Name, Description, Subject, Language, CoverAsset, Version, UpdatedAt
+		from Decks
+		where UserID = $1 and UpdatedAt > $2 and DeletedAt is null
+		order by ID`
+	rows, err := db.pool.Query(context.Background(), str, userId, since)
+	if err != nil {
+		return SyncChanges{}, cursor, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d SyncedDeck
+		err := rows.Scan(
+			&d.ID, &d.Name, &d.Description, &d.Subject, &d.Language,
+			&d.CoverAsset, &d.Version, &d.UpdatedAt,
+		)
+		if err != nil {
+			return SyncChanges{}, cursor, err
+		}
+		changes.Decks = append(changes.Decks, d)
+	}
+	if err := rows.Err(); err != nil {
+		return SyncChanges{}, cursor, err
+	}
+
+	str = `
+		select f.ID, f.DeckID, f.Front, f.Back, f.Position, f.Version, f.Due, f.UpdatedAt
+		from Flashcards f join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and (f.UpdatedAt > $2 or f.ScheduledAt > $2)
+		and d.DeletedAt is null and f.DeletedAt is null
+		order by f.DeckID, f.Position, f.ID`
+	rows, err = db.pool.Query(context.Background(), str, userId, since)
+	if err != nil {
+		return SyncChanges{}, cursor, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c SyncedCard
+		err := rows.Scan(
+			&c.ID, &c.DeckID, &c.Front, &c.Back, &c.Position, &c.Version, &c.Due, &c.UpdatedAt,
+		)
+		if err != nil {
+			return SyncChanges{}, cursor, err
+		}
+		changes.Cards = append(changes.Cards, c)
+	}
+	if err := rows.Err(); err != nil {
+		return SyncChanges{}, cursor, err
+	}
+
+	str = "select DeckID, CardID from Tombstones where UserID = $1 and DeletedAt > $2"
+	rows, err = db.pool.Query(context.Background(), str, userId, since)
+	if err != nil {
+		return SyncChanges{}, cursor, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deckId, cardId int
+		if err := rows.Scan(&deckId, &cardId); err != nil {
+			return SyncChanges{}, cursor, err
+		}
+
+		if cardId == 0 {
+			changes.DeletedDecks = append(changes.DeletedDecks, deckId)
+		} else {
+			changes.DeletedCards = append(changes.DeletedCards, cardId)
+		}
+	}
+
+	return changes, cursor, rows.Err()
+}
+
+type SyncData struct {
+	Cursor    string         `json:"cursor"`
+	Mutations []SyncMutation `json:"mutations" binding:"dive"`
+}
+
+// Apply the mutations the client made while offline, then respond with
+// the result of each mutation and everything that changed since the
+// client's cursor. An empty cursor fetches everything, and so does
+// an expired one, in which case reset is set to true
+func (app *App) Sync(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data SyncData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	if len(data.Mutations) > 500 {
+		handleResponse(ctx, http.StatusBadRequest, "too many mutations")
+		return
+	}
+
+	for _, m := range data.Mutations {
+		if !slices.Contains(mutationTypes, m.Type) {
+			handleResponse(ctx, http.StatusBadRequest, "invalid mutation type: "+m.Type)
+			return
+		}
+	}
+
+	since := time.Time{}
+	if data.Cursor != "" {
+		values, err := decodeCursor(data.Cursor, 1)
+		if err != nil {
+			handleResponse(ctx, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		since = time.UnixMicro(values[0])
+	}
+
+	reset := false
+	if !since.IsZero() && time.Since(since) > tombstoneRetention {
+		since, reset = time.Time{}, true
+	}
+
+	results, err := app.db.applyMutations(userId, data.Mutations)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	changes, cursor, err := app.db.getChanges(userId, since)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{
+		"results": results,
+		"changes": changes,
+		"reset":   reset,
+		"cursor":  encodeCursor(cursor.UnixMicro()),
+	}
+	handleResponse(ctx, http.StatusOK, response)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const maxTags = 20
+
+// Tags are case insensitive and can't contain commas
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) == 0 || len(tag) > 50 || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("invalid tag: %q", tag)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("too many tags")
+	}
+	return normalized, nil
+}
+
+func (db *Database) getTags(userId string) ([]string, error) {
+	str := "select Name from Tags where UserID = $1 order by Name"
+	rows, err := db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// Make sure each tag exists, then replace the tags attached to the
+// object in the join table (DeckTags or CardTags) with the new ones.
+// Tags that are no longer used get removed
+func replaceTags(tx pgx.Tx, userId string, tags []string, table string, id int) error {
+	str := `
+		insert into Tags (UserID, Name) select $1, unnest($2::text[])
+		on conflict (UserID, Name) do nothing`
+	_, err := tx.Exec(context.Background(), str, userId, tags)
+	if err != nil {
+		return err
+	}
+
+	column := map[string]string{"DeckTags": "DeckID", "CardTags": "CardID"}[table]
+
+	str = fmt.Sprintf("delete from %s where %s = $1", table, column)
+	if _, err := tx.Exec(context.Background(), str, id); err != nil {
+		return err
+	}
+
+	str = fmt.Sprintf(`
+		insert into %s (%s, TagID)
+		select $1, ID from Tags where UserID = $2 and Name = any($3)`, table, column)
+	if _, err := tx.Exec(context.Background(), str, id, userId, tags); err != nil {
+		return err
+	}
+
+	str = `
+		delete from Tags t where t.UserID = $1
+		and not exists (select 1 from DeckTags where TagID = t.ID)
+		and not exists (select 1 from CardTags where TagID = t.ID)`
+	_, err = tx.Exec(context.Background(), str, userId)
+	return err
+}
+
+func (db *Database) setDeckTags(userId string, deckId int, tags []string) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	str := `
+		update Decks set UpdatedAt = now()
+		where UserID = $1 and ID = $2 and DeletedAt is null`
+	tag, err := tx.Exec(context.Background(), str, userId, deckId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeckNotFound
+	}
+
+	if err := replaceTags(tx, userId, tags, "DeckTags", deckId); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (db *Database) setCardTags(userId string, cardId int, tags []string) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var exists bool
+	str := `
+		select exists (
+			select 1 from Flashcards f join Decks d on d.ID = f.DeckID
+			where d.UserID = $1 and f.ID = $2
+			and d.DeletedAt is null and f.DeletedAt is null
+		)`
+	err = tx.QueryRow(context.Background(), str, userId, cardId).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrCardNotFound
+	}
+
+	if err := replaceTags(tx, userId, tags, "CardTags", cardId); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (app *App) GetTags(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	tags, err := app.db.getTags(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"tags": tags}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+type SetTagsData struct {
+	Tags []string `json:"tags" binding:"required"`
+}
+
+// Replace the tags of a deck, or of a card when cards is true
+func (app *App) setTags(ctx *gin.Context, cards bool) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	id, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var data SetTagsData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	tags, err := normalizeTags(data.Tags)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if cards {
+		err = app.db.setCardTags(userId, id, tags)
+	} else {
+		err = app.db.setDeckTags(userId, id, tags)
+	}
+
+	if err == ErrDeckNotFound || err == ErrCardNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"tags": tags}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+func (app *App) SetDeckTags(ctx *gin.Context) { app.setTags(ctx, false) }
+
+func (app *App) SetCardTags(ctx *gin.Context) { app.setTags(ctx, true) }
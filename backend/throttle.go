@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Failed logins are counted per ip address and per account. After a few
+// free failures, every failure locks the key out for twice as long as the
+// one before it, up to a limit. Failures are forgotten after a quiet day,
+// and a successful login clears the account's failures. The ip limit is
+// higher, since schools put many users behind the same address. Attempts
+// are counted as failures before they're made, and forgiven afterwards
+// when they didn't fail
+const (
+	accountFreeFailures = 5
+	ipFreeFailures      = 20
+	baseLockout         = time.Second
+	maxLockout          = time.Hour
+	failureMemory       = 24 * time.Hour
+)
+
+var ErrLockedOut error = fmt.Errorf("too many attempts, try again later")
+
+// Get the proxies allowed to tell us the client's ip through X-Forwarded-For,
+// from TRUSTED_PROXIES (comma separated addresses or CIDR ranges). Without
+// them, the client's ip is the address the request came from. Trusting every
+// address would let clients pick their own ip and dodge the ip limits
+func (app *App) trustedProxies() []string {
+	proxies := []string{}
+	for _, proxy := range strings.Split(app.secrets["TRUSTED_PROXIES"], ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// A key attempts are counted under, along with the failures it gets for free
+type throttleKey struct {
+	key  string
+	free int
+}
+
+func ipThrottleKey(ip string) throttleKey {
+	return throttleKey{"ip:" + ip, ipFreeFailures}
+}
+
+func accountThrottleKey(email string) throttleKey {
+	email = strings.ToLower(strings.TrimSpace(email))
+	return throttleKey{"account:" + email, accountFreeFailures}
+}
+
+// Second factor codes are only 6 digits, so guesses are counted per user
+func secondFactorThrottleKey(userId string) throttleKey {
+	return throttleKey{"2fa:" + userId, accountFreeFailures}
+}
+
+func lockoutDuration(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	exponent := float64(failures - free)
+	lockout := float64(baseLockout) * math.Pow(2, exponent)
+	return time.Duration(min(lockout, float64(maxLockout)))
+}
+
+// An attempt that was counted against its keys before it was made, along
+// with each key's lockout before and after it was counted. Counting attempts
+// up front means attempts made at the same time can't all get past the
+// lockout before any of their failures are recorded
+type throttleAttempt struct {
+	keys     []throttleKey
+	previous []*time.Time
+	counted  []*time.Time
+}
+
+// Count an attempt as a failure of every key, unless one of the keys is
+// locked out. Then nothing is counted, and the remaining lockout is returned
+// with ErrLockedOut. Each key is counted and checked in a single statement,
+// and its row stays locked until all the keys are counted
+func (db *Database) reserveAttempt(keys ...throttleKey) (throttleAttempt, time.Duration, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return throttleAttempt{}, 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	attempt := throttleAttempt{keys: keys}
+	cutoff := time.Now().Add(-failureMemory)
+	for _, key := range keys {
+		var failures int
+		var previous *time.Time
+		str := `
+			with previous as (select LockedUntil from LoginAttempts where Key = $1)
+			insert into LoginAttempts as a (Key, Failures, LastFailureAt)
+			values ($1, 1, now())
+			on conflict (Key) do update set
+				Failures = case when a.LastFailureAt < $2 then 1 else a.Failures + 1 end,
+				LastFailureAt = now()
+			where a.LockedUntil is null or a.LockedUntil <= now()
+			returning a.Failures, (select LockedUntil from previous)`
+		err := tx.QueryRow(context.Background(), str, key.key, cutoff).Scan(&failures, &previous)
+		if err == pgx.ErrNoRows {
+			var lockedUntil time.Time
+			str = "select LockedUntil from LoginAttempts where Key = $1"
+			err := tx.QueryRow(context.Background(), str, key.key).Scan(&lockedUntil)
+			if err != nil {
+				return throttleAttempt{}, 0, err
+			}
+			return throttleAttempt{}, max(time.Until(lockedUntil), 0), ErrLockedOut
+		} else if err != nil {
+			return throttleAttempt{}, 0, err
+		}
+
+		counted := previous
+		if lockout := lockoutDuration(failures, key.free); lockout > 0 {
+			// Postgres only keeps microseconds, so the lockout can be compared later
+			lockedUntil := time.Now().Add(lockout).Truncate(time.Microsecond)
+			str = "update LoginAttempts set LockedUntil = $2 where Key = $1"
+			_, err := tx.Exec(context.Background(), str, key.key, lockedUntil)
+			if err != nil {
+				return throttleAttempt{}, 0, err
+			}
+			counted = &lockedUntil
+		}
+		attempt.previous = append(attempt.previous, previous)
+		attempt.counted = append(attempt.counted, counted)
+	}
+
+	return attempt, 0, tx.Commit(context.Background())
+}
+
+// Stop counting an attempt as a failure of the key, putting back the lockout
+// it had before, unless a later failure has locked it out since
+func (db *Database) forgiveAttempt(attempt throttleAttempt, key throttleKey) error {
+	for i, k := range attempt.keys {
+		if k != key {
+			continue
+		}
+
+		str := `
+			update LoginAttempts set
+				Failures = greatest(Failures - 1, 0),
+				LockedUntil = case when LockedUntil is not distinct from $3
+					then $2 else LockedUntil end
+			where Key = $1`
+		_, err := db.pool.Exec(
+			context.Background(), str, key.key, attempt.previous[i], attempt.counted[i])
+		return err
+	}
+	return nil
+}
+
+func (db *Database) clearFailures(keys ...throttleKey) error {
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.key
+	}
+
+	str := "delete from LoginAttempts where Key = any($1)"
+	_, err := db.pool.Exec(context.Background(), str, names)
+	return err
+}
+
+func (db *Database) pruneLoginAttempts() error {
+	str := `
+		delete from LoginAttempts
+		where LastFailureAt < $1 and (LockedUntil is null or LockedUntil < now())`
+	_, err := db.pool.Exec(context.Background(), str, time.Now().Add(-failureMemory))
+	if err != nil {
+		return err
+	}
+
+	str = "delete from UsedChallenges where ExpiresAt < now()"
+	_, err = db.pool.Exec(context.Background(), str)
+	return err
+}
+
+// Count an attempt against the keys, responding with an error when any of
+// them are locked out. Returns whether the attempt can go ahead
+func (app *App) reserveAttempt(ctx *gin.Context, keys ...throttleKey) (throttleAttempt, bool) {
+	attempt, lockout, err := app.db.reserveAttempt(keys...)
+	if err == ErrLockedOut {
+		seconds := int(math.Ceil(lockout.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(max(seconds, 1)))
+		handleResponse(ctx, http.StatusTooManyRequests, err.Error())
+		return attempt, false
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return attempt, false
+	}
+	return attempt, true
+}
+
+// Once it's known how an attempt went, keep counting it as a failure
+// of the keys it failed for, and forgive it for the rest
+func (app *App) settleAttempt(attempt throttleAttempt, failed ...throttleKey) {
+	for _, key := range attempt.keys {
+		if slices.Contains(failed, key) {
+			continue
+		}
+		if err := app.db.forgiveAttempt(attempt, key); err != nil {
+			log.Printf("forgiving an attempt for %s failed: %v", key.key, err)
+		}
+	}
+}
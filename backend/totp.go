@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Two-factor authentication uses time based one time passwords (RFC 6238),
+// so any authenticator app works. Users enroll by adding the secret to their
+// app, then confirm it with a code, which is when they get their recovery
+// codes. Recovery codes can be used instead of a code when the user loses
+// their device, and each one only works once
+const (
+	totpIssuer = "Snapcram"
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from this many periods before or after the current one are
+	// accepted, since the clocks of phones drift
+	totpSkew          = 1
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+)
+
+var ErrTOTPEnabled error = fmt.Errorf("two-factor authentication is already enabled")
+var ErrTOTPNotEnabled error = fmt.Errorf("two-factor authentication isn't enabled")
+var ErrTOTPNotEnrolled error = fmt.Errorf("two-factor authentication wasn't set up")
+var ErrInvalidCode error = fmt.Errorf("invalid code")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var totpCodePattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+// Compute the one time password for a counter (RFC 4226)
+func hotp(secret []byte, counter uint64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// Find the time step the code was generated for. Steps up to and
+// including the last step that was used are rejected, so codes
+// can't be replayed
+func matchTOTP(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(secret, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func generateTOTPSecret() (string, error) {
+	bytes := make([]byte, totpSecretSize)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(bytes), nil
+}
+
+// Build the uri authenticator apps read from a qr code
+func otpauthURI(secret, email string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// Recovery codes are formatted like xxxx-xxxx-xxxx-xxxx
+func generateRecoveryCode() (string, error) {
+	bytes := make([]byte, 10)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	encoded := strings.ToLower(totpEncoding.EncodeToString(bytes))
+	groups := []string{}
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// Replace the user's recovery codes with new ones
+func replaceRecoveryCodes(tx pgx.Tx, userId string) ([]string, error) {
+	str := "delete from RecoveryCodes where UserID = $1"
+	if _, err := tx.Exec(context.Background(), str, userId); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i], hashes[i] = code, hashToken(normalizeRecoveryCode(code))
+	}
+
+	str = `
+		insert into RecoveryCodes (UserID, Hash)
+		select $1, unnest($2::text[])`
+	_, err := tx.Exec(context.Background(), str, userId, hashes)
+	return codes, err
+}
+
+func (db *Database) totpEnabled(userId string) (bool, error) {
+	var enabled bool
+	str := "select TOTPEnabled from Users where ID = $1"
+	err := db.pool.QueryRow(context.Background(), str, userId).Scan(&enabled)
+	if err == pgx.ErrNoRows {
+		return false, ErrUserNotFound
+	}
+	return enabled, err
+}
+
+// Store a new secret that's only used once the user confirms it
+func (db *Database) enrollTOTP(userId, secret string) error {
+	str := "update Users set TOTPSecret = $2 where ID = $1 and not TOTPEnabled"
+	result, err := db.pool.Exec(context.Background(), str, userId, secret)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+// Check a code from the user's authenticator app, or one of their recovery
+// codes when allowed. The user's row is locked until the transaction ends
+func checkSecondFactor(tx pgx.Tx, userId, code string, enabled, allowRecovery bool) error {
+	var secret *string
+	var isEnabled bool
+	var lastStep int64
+	str := `
+		select TOTPSecret, TOTPEnabled, TOTPLastStep
+		from Users where ID = $1 for update`
+	err := tx.QueryRow(context.Background(), str, userId).Scan(&secret, &isEnabled, &lastStep)
+	if err == pgx.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if enabled && !isEnabled {
+		return ErrTOTPNotEnabled
+	} else if !enabled && isEnabled {
+		return ErrTOTPEnabled
+	} else if secret == nil {
+		return ErrTOTPNotEnrolled
+	}
+
+	code = strings.TrimSpace(code)
+	if totpCodePattern.MatchString(code) {
+		key, err := totpEncoding.DecodeString(*secret)
+		if err != nil {
+			return err
+		}
+
+		step, ok := matchTOTP(key, code, time.Now(), lastStep)
+		if !ok {
+			return ErrInvalidCode
+		}
+
+		str = "update Users set TOTPLastStep = $2 where ID = $1"
+		_, err = tx.Exec(context.Background(), str, userId, step)
+		return err
+	}
+
+	if !allowRecovery {
+		return ErrInvalidCode
+	}
+
+	str = `
+		update RecoveryCodes set UsedAt = now()
+		where UserID = $1 and Hash = $2 and UsedAt is null`
+	hash := hashToken(normalizeRecoveryCode(code))
+	result, err := tx.Exec(context.Background(), str, userId, hash)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Enable two-factor authentication once the user proves their
+// app was set up, then return their new recovery codes
+func (db *Database) confirmTOTP(userId, code string) ([]string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := checkSecondFactor(tx, userId, code, false, false); err != nil {
+		return nil, err
+	}
+
+	str := "update Users set TOTPEnabled = true where ID = $1"
+	if _, err := tx.Exec(context.Background(), str, userId); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(context.Background())
+}
+
+func (db *Database) verifySecondFactor(userId, code string) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := checkSecondFactor(tx, userId, code, true, true); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func (db *Database) disableTOTP(userId, code string) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := checkSecondFactor(tx, userId, code, true, true); err != nil {
+		return err
+	}
+
+	str := `
+		update Users set TOTPSecret = null, TOTPEnabled = false, TOTPLastStep = 0
+		where ID = $1`
+	if _, err := tx.Exec(context.Background(), str, userId); err != nil {
+		return err
+	}
+
+	str = "delete from RecoveryCodes where UserID = $1"
+	if _, err := tx.Exec(context.Background(), str, userId); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func (db *Database) regenerateRecoveryCodes(userId, code string) ([]string, error) {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := checkSecondFactor(tx, userId, code, true, false); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(context.Background())
+}
+
+// Respond with a new secret along with the otpauth uri to show as a qr code
+func (app *App) EnrollTOTP(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	email, _, err := app.db.getUserEmail(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	err = app.db.enrollTOTP(userId, secret)
+	if err == ErrTOTPEnabled {
+		handleResponse(ctx, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"secret": secret, "uri": otpauthURI(secret, email)}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+type TOTPCodeData struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// Respond with an error message for the errors checking a code can return
+func handleSecondFactorError(ctx *gin.Context, err error) {
+	if err == ErrInvalidCode {
+		handleResponse(ctx, http.StatusUnauthorized, err.Error())
+	} else if err == ErrTOTPEnabled {
+		handleResponse(ctx, http.StatusConflict, err.Error())
+	} else if err == ErrTOTPNotEnabled || err == ErrTOTPNotEnrolled {
+		handleResponse(ctx, http.StatusBadRequest, err.Error())
+	} else {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+	}
+}
+
+// Check a code with the check function, counting the attempt against the
+// user's second factor and their ip. A wrong code counts as a failure and a
+// right one clears the user's failures. Responds with an error and returns
+// false when the attempt is locked out or the check fails
+func (app *App) attemptSecondFactor(
+	ctx *gin.Context, userId string, check func() error) bool {
+	ipKey, userKey := ipThrottleKey(ctx.ClientIP()), secondFactorThrottleKey(userId)
+	attempt, ok := app.reserveAttempt(ctx, ipKey, userKey)
+	if !ok {
+		return false
+	}
+	// The keys the attempt failed for, it's forgiven for the others
+	var failed []throttleKey
+	defer func() { app.settleAttempt(attempt, failed...) }()
+
+	if err := check(); err != nil {
+		if err == ErrInvalidCode {
+			failed = []throttleKey{ipKey, userKey}
+		}
+		handleSecondFactorError(ctx, err)
+		return false
+	}
+
+	if err := app.db.clearFailures(userKey); err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return false
+	}
+	return true
+}
+
+func (app *App) ConfirmTOTP(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data TOTPCodeData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var codes []string
+	confirmed := app.attemptSecondFactor(ctx, userId, func() (err error) {
+		codes, err = app.db.confirmTOTP(userId, data.Code)
+		return err
+	})
+	if !confirmed {
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, map[string]any{"recoveryCodes": codes})
+}
+
+func (app *App) DisableTOTP(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data TOTPCodeData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	disabled := app.attemptSecondFactor(ctx, userId, func() error {
+		return app.db.disableTOTP(userId, data.Code)
+	})
+	if !disabled {
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
+
+// Replace the user's recovery codes, which requires a code from their app
+func (app *App) RegenerateRecoveryCodes(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	var data TOTPCodeData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	var codes []string
+	regenerated := app.attemptSecondFactor(ctx, userId, func() (err error) {
+		codes, err = app.db.regenerateRecoveryCodes(userId, data.Code)
+		return err
+	})
+	if !regenerated {
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, map[string]any{"recoveryCodes": codes})
+}
+
+type VerifyTOTPData struct {
+	PartialToken string `json:"partialToken" binding:"required"`
+	Code         string `json:"code" binding:"required"`
+}
+
+// Finish logging in by exchanging the partial token and a
+// code (or recovery code) for an access and refresh token
+func (app *App) VerifyTOTP(ctx *gin.Context) {
+	var data VerifyTOTPData
+	if err := ctx.ShouldBindJSON(&data); err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	userId, err := parsePartialToken(data.PartialToken, app.keys)
+	if err != nil {
+		handleResponse(ctx, http.StatusUnauthorized, "invalid or expired token")
+		return
+	}
+
+	verified := app.attemptSecondFactor(ctx, userId, func() error {
+		return app.db.verifySecondFactor(userId, data.Code)
+	})
+	if !verified {
+		return
+	}
+
+	tokens, err := app.issueTokens(userId, ctx.Request.UserAgent(), ctx.ClientIP())
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, tokens)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// The shared secret used by the test vectors in RFC 4226 and RFC 6238
+var rfcSecret = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226, appendix D
+	expected := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	for counter, code := range expected {
+		if got := hotp(rfcSecret, uint64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, expected %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238, appendix B (SHA1), keeping the last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		now := time.Unix(test.unix, 0)
+		step, ok := matchTOTP(rfcSecret, test.code, now, 0)
+		if !ok {
+			t.Errorf("the code for %d wasn't accepted", test.unix)
+			continue
+		}
+		if step != test.unix/totpPeriod {
+			t.Errorf("the code for %d matched step %d, expected %d",
+				test.unix, step, test.unix/totpPeriod)
+		}
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		offset   int64
+		accepted bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+
+	for _, test := range tests {
+		code := hotp(rfcSecret, uint64(current+test.offset))
+		step, ok := matchTOTP(rfcSecret, code, now, 0)
+		if ok != test.accepted {
+			t.Errorf("the code from %d steps away accepted: %t, expected %t",
+				test.offset, ok, test.accepted)
+		}
+		if ok && step != current+test.offset {
+			t.Errorf("the code from %d steps away matched step %d", test.offset, step)
+		}
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	code := hotp(rfcSecret, uint64(current))
+
+	step, ok := matchTOTP(rfcSecret, code, now, 0)
+	if !ok || step != current {
+		t.Fatalf("the code wasn't accepted the first time")
+	}
+
+	// Once a step is used, its code and the codes before it are rejected
+	if _, ok := matchTOTP(rfcSecret, code, now, step); ok {
+		t.Errorf("the code was accepted again")
+	}
+	previous := hotp(rfcSecret, uint64(current-1))
+	if _, ok := matchTOTP(rfcSecret, previous, now, step); ok {
+		t.Errorf("a code from before the last used step was accepted")
+	}
+
+	// Codes after the last used step still work
+	next := hotp(rfcSecret, uint64(current+1))
+	if _, ok := matchTOTP(rfcSecret, next, now, step); !ok {
+		t.Errorf("a code after the last used step was rejected")
+	}
+}
+
+func TestTOTPInvalidCodes(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	for _, code := range []string{"", "00592", "0059240", "abcdef", "005925"} {
+		if _, ok := matchTOTP(rfcSecret, code, now, 0); ok {
+			t.Errorf("the code %q was accepted", code)
+		}
+	}
+}
+
+func TestGenerateRecoveryCode(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}$`)
+	seen := map[string]bool{}
+
+	for i := 0; i < 100; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pattern.MatchString(code) {
+			t.Errorf("the recovery code %q isn't formatted like xxxx-xxxx-xxxx-xxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("the recovery code %q was generated twice", code)
+		}
+		seen[code] = true
+
+		if normalized := normalizeRecoveryCode(code); len(normalized) != 16 {
+			t.Errorf("the recovery code %q normalized to %q", code, normalized)
+		}
+	}
+
+	if normalizeRecoveryCode("ABCD-efgh 2345-6777") != "abcdefgh23456777" {
+		t.Errorf("recovery codes should ignore case, dashes and spaces")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Deleted decks and cards stay in the trash for this long before they're purged
+const trashRetention = 30 * 24 * time.Hour
+
+type TrashedDeck struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CardCount int       `json:"cardCount"`
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+// A card that was deleted from a deck that isn't in the trash itself
+type TrashedCard struct {
+	ID        int       `json:"id"`
+	DeckID    int       `json:"deckId"`
+	DeckName  string    `json:"deckName"`
+	Front     string    `json:"front"`
+	Back      string    `json:"back"`
+	DeletedAt time.Time `json:"deletedAt"`
+	PurgeAt   time.Time `json:"purgeAt"`
+}
+
+func (db *Database) getTrash(userId string) ([]TrashedDeck, []TrashedCard, error) {
+	str := `
+		select d.ID, d.Name, d.DeletedAt, (
+			select count(*) from Flashcards f
+			where f.DeckID = d.ID and f.DeletedAt is null
+		)
+		from Decks d
+		where d.UserID = $1 and d.DeletedAt is not null
+		order by d.DeletedAt desc`
+	rows, err := db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	decks := []TrashedDeck{}
+	for rows.Next() {
+		var d TrashedDeck
+		if err := rows.Scan(&d.ID, &d.Name, &d.DeletedAt, &d.CardCount); err != nil {
+			return nil, nil, err
+		}
+		d.PurgeAt = d.DeletedAt.Add(trashRetention)
+		decks = append(decks, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	str = `
+		select f.ID, f.DeckID, d.Name, f.Front, f.Back, f.DeletedAt
+		from Flashcards f join Decks d on d.ID = f.DeckID
+		where d.UserID = $1 and d.DeletedAt is null and f.DeletedAt is not null
+		order by f.DeletedAt desc`
+	rows, err = db.pool.Query(context.Background(), str, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	cards := []TrashedCard{}
+	for rows.Next() {
+		var c TrashedCard
+		err := rows.Scan(&c.ID, &c.DeckID, &c.DeckName, &c.Front, &c.Back, &c.DeletedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.PurgeAt = c.DeletedAt.Add(trashRetention)
+		cards = append(cards, c)
+	}
+
+	return decks, cards, rows.Err()
+}
+
+func (db *Database) restoreDeck(userId string, deckId int) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	str := `
+		update Decks set DeletedAt = null, UpdatedAt = now(), Version = Version + 1
+		where UserID = $1 and ID = $2 and DeletedAt is not null`
+	tag, err := tx.Exec(context.Background(), str, userId, deckId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrDeckNotFound
+	}
+
+	// Devices that synced the deletion dropped the deck's cards,
+	// so they need to be sent again
+	str = "update Flashcards set UpdatedAt = now() where DeckID = $1 and DeletedAt is null"
+	if _, err := tx.Exec(context.Background(), str, deckId); err != nil {
+		return err
+	}
+
+	str = "delete from Tombstones where UserID = $1 and DeckID = $2 and CardID = 0"
+	if _, err := tx.Exec(context.Background(), str, userId, deckId); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Restore a card, as long as its deck isn't in the trash
+func (db *Database) restoreCard(userId string, cardId int) error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var deckId int
+	card := Card{ID: cardId}
+	str := `
+		update Flashcards f set DeletedAt = null, UpdatedAt = now(), Version = f.Version + 1
+		from Decks d
+		where d.ID = f.DeckID and d.UserID = $1 and d.DeletedAt is null
+		and f.ID = $2 and f.DeletedAt is not null
+		returning f.DeckID, f.Front, f.Back`
+	err = tx.QueryRow(context.Background(), str, userId, cardId).Scan(
+		&deckId, &card.Front, &card.Back)
+	if err == pgx.ErrNoRows {
+		return ErrCardNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := recordRevision(tx, userId, cardId, revisionRestored, nil, &card); err != nil {
+		return err
+	}
+
+	if err := bumpDeckVersion(tx, deckId); err != nil {
+		return err
+	}
+
+	str = "delete from Tombstones where UserID = $1 and CardID = $2"
+	if _, err := tx.Exec(context.Background(), str, userId, cardId); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// Permanently delete the decks and cards that have been in the trash for too
+// long, along with everything attached to them. Old tombstones, sync mutation
+// records and assets that never got attached to a deck are pruned as well
+func (db *Database) purgeTrash() error {
+	tx, err := db.pool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	cutoff := time.Now().Add(-trashRetention)
+
+	var deckIds, cardIds []int
+	str := "select coalesce(array_agg(ID), '{}') from Decks where DeletedAt < $1"
+	err = tx.QueryRow(context.Background(), str, cutoff).Scan(&deckIds)
+	if err != nil {
+		return err
+	}
+
+	str = `
+		select coalesce(array_agg(ID), '{}') from Flashcards
+		where DeletedAt < $1 or DeckID = any($2)`
+	err = tx.QueryRow(context.Background(), str, cutoff, deckIds).Scan(&cardIds)
+	if err != nil {
+		return err
+	}
+
+	statements := []struct {
+		str string
+		ids []int
+	}{
+		{"delete from CardTags where CardID = any($1)", cardIds},
+		{"delete from CardRevisions where CardID = any($1)", cardIds},
+		{"delete from Reviews where CardID = any($1)", cardIds},
+		{"delete from CardExplanations where CardID = any($1)", cardIds},
+		{"delete from Flashcards where ID = any($1)", cardIds},
+		{"delete from DeckTags where DeckID = any($1)", deckIds},
+		{"delete from DeckFlags where DeckID = any($1)", deckIds},
+		{"delete from Assets where DeckID = any($1)", deckIds},
+		{"delete from Decks where ID = any($1)", deckIds},
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(context.Background(), s.str, s.ids); err != nil {
+			return err
+		}
+	}
+
+	str = "delete from Assets where DeckID is null and CreatedAt < $1"
+	_, err = tx.Exec(context.Background(), str, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	syncCutoff := time.Now().Add(-tombstoneRetention)
+	str = "delete from Tombstones where DeletedAt < $1"
+	if _, err := tx.Exec(context.Background(), str, syncCutoff); err != nil {
+		return err
+	}
+
+	str = "delete from SyncMutations where CreatedAt < $1"
+	if _, err := tx.Exec(context.Background(), str, syncCutoff); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func (app *App) GetTrash(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	decks, cards, err := app.db.getTrash(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{"decks": decks, "cards": cards}
+	handleResponse(ctx, http.StatusOK, response)
+}
+
+func (app *App) RestoreDeck(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	deckId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	err = app.db.restoreDeck(userId, deckId)
+	if err == ErrDeckNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	deck, err := app.db.getDeck(userId, deckId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, deck)
+}
+
+func (app *App) RestoreCard(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	cardId, err := pathID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, nil)
+		return
+	}
+
+	err = app.db.restoreCard(userId, cardId)
+	if err == ErrCardNotFound {
+		handleResponse(ctx, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, nil)
+}
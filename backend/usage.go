@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Every llm request is recorded in a ledger, along with the tokens and
+// images it used up. Users are on a plan, and each plan can have daily and
+// monthly quotas. Users start on the free plan. Quotas are configured as
+// QUOTA_<PLAN>_<DAILY|MONTHLY>_<TOKENS|IMAGES>, like QUOTA_FREE_DAILY_TOKENS.
+// Quotas that aren't set are unlimited. Days and months are in UTC
+//
+// Requests are only refused once a quota is used up, since we can't know how
+// many tokens a request will use beforehand. So a user can go over their
+// quota by one request (or a few, when they're made at the same time)
+const (
+	usageGenerate = "generate"
+	usageDeck     = "deck"
+	usageGrade    = "grade"
+	usageExplain  = "explain"
+)
+
+// Zero means unlimited
+type Quota struct {
+	Tokens int
+	Images int
+}
+
+type PlanQuotas struct {
+	Daily   Quota
+	Monthly Quota
+}
+
+type PeriodUsage struct {
+	Tokens int `json:"tokens"`
+	Images int `json:"images"`
+	// Null when there's no limit
+	TokenLimit *int      `json:"tokenLimit"`
+	ImageLimit *int      `json:"imageLimit"`
+	ResetAt    time.Time `json:"resetAt"`
+}
+
+type UsageSummary struct {
+	Plan    string      `json:"plan"`
+	Daily   PeriodUsage `json:"daily"`
+	Monthly PeriodUsage `json:"monthly"`
+}
+
+var ErrQuotaExceeded error = fmt.Errorf("usage quota exceeded")
+
+func loadQuotas(secrets map[string]string) (map[string]PlanQuotas, error) {
+	quotas := map[string]PlanQuotas{}
+	for name, value := range secrets {
+		rest, found := strings.CutPrefix(name, "QUOTA_")
+		if !found {
+			continue
+		}
+
+		parts := strings.Split(rest, "_")
+		if len(parts) < 3 {
+			return nil, fmt.Errorf("%s should be QUOTA_<PLAN>_<PERIOD>_<RESOURCE>", name)
+		}
+		plan := strings.ToLower(strings.Join(parts[:len(parts)-2], "_"))
+		period, resource := parts[len(parts)-2], parts[len(parts)-1]
+
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("%s can't be negative", name)
+		}
+
+		planQuotas := quotas[plan]
+		var quota *Quota
+		if period == "DAILY" {
+			quota = &planQuotas.Daily
+		} else if period == "MONTHLY" {
+			quota = &planQuotas.Monthly
+		} else {
+			return nil, fmt.Errorf("%s has an unknown period", name)
+		}
+
+		if resource == "TOKENS" {
+			quota.Tokens = limit
+		} else if resource == "IMAGES" {
+			quota.Images = limit
+		} else {
+			return nil, fmt.Errorf("%s has an unknown resource", name)
+		}
+		quotas[plan] = planQuotas
+	}
+	return quotas, nil
+}
+
+func (db *Database) recordUsage(userId, action string, usage Usage) error {
+	str := `
+		insert into UsageLedger
+			(UserID, Action, PromptTokens, CompletionTokens, TotalTokens, Images)
+		values ($1, $2, $3, $4, $5, $6)`
+	_, err := db.pool.Exec(
+		context.Background(), str, userId, action, usage.PromptTokens,
+		usage.CompletionTokens, usage.TotalTokens, usage.Images,
+	)
+	return err
+}
+
+func (db *Database) getPlan(userId string) (string, error) {
+	var plan string
+	str := "select Plan from Users where ID = $1"
+	err := db.pool.QueryRow(context.Background(), str, userId).Scan(&plan)
+	if err == pgx.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return plan, err
+}
+
+// Get the tokens and images the user used since the start of the day and month
+func (db *Database) getUsageTotals(userId string, day, month time.Time) (Usage, Usage, error) {
+	var daily, monthly Usage
+	str := `
+		select
+			coalesce(sum(TotalTokens) filter (where CreatedAt >= $2), 0),
+			coalesce(sum(Images) filter (where CreatedAt >= $2), 0),
+			coalesce(sum(TotalTokens), 0),
+			coalesce(sum(Images), 0)
+		from UsageLedger where UserID = $1 and CreatedAt >= $3`
+	err := db.pool.QueryRow(context.Background(), str, userId, day, month).Scan(
+		&daily.TotalTokens, &daily.Images, &monthly.TotalTokens, &monthly.Images)
+	return daily, monthly, err
+}
+
+func periodUsage(used Usage, quota Quota, resetAt time.Time) PeriodUsage {
+	usage := PeriodUsage{Tokens: used.TotalTokens, Images: used.Images, ResetAt: resetAt}
+	if quota.Tokens > 0 {
+		usage.TokenLimit = &quota.Tokens
+	}
+	if quota.Images > 0 {
+		usage.ImageLimit = &quota.Images
+	}
+	return usage
+}
+
+// Whether the period's quota is used up, or would be by sending more images
+func (p PeriodUsage) exceeded(images int) bool {
+	outOfTokens := p.TokenLimit != nil && p.Tokens >= *p.TokenLimit
+	outOfImages := p.ImageLimit != nil && p.Images+images > *p.ImageLimit
+	return outOfTokens || outOfImages
+}
+
+// Check whether any quota is used up, and if so, when the user can make requests again
+func (s UsageSummary) exceeded(images int) (time.Time, bool) {
+	if s.Monthly.exceeded(images) {
+		return s.Monthly.ResetAt, true
+	} else if s.Daily.exceeded(images) {
+		return s.Daily.ResetAt, true
+	}
+	return time.Time{}, false
+}
+
+func (app *App) getUsage(userId string) (UsageSummary, error) {
+	plan, err := app.db.getPlan(userId)
+	if err != nil {
+		return UsageSummary{}, err
+	}
+
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	daily, monthly, err := app.db.getUsageTotals(userId, day, month)
+	if err != nil {
+		return UsageSummary{}, err
+	}
+
+	quotas := app.quotas[plan]
+	summary := UsageSummary{
+		Plan:    plan,
+		Daily:   periodUsage(daily, quotas.Daily, day.AddDate(0, 0, 1)),
+		Monthly: periodUsage(monthly, quotas.Monthly, month.AddDate(0, 1, 0)),
+	}
+	return summary, nil
+}
+
+// Respond with an error when the user is out of quota, including when
+// their quota resets. Returns whether the request can go ahead
+func (app *App) checkQuota(ctx *gin.Context, userId string, images int) bool {
+	summary, err := app.getUsage(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return false
+	}
+
+	resetAt, exceeded := summary.exceeded(images)
+	if !exceeded {
+		return true
+	}
+
+	seconds := int(math.Ceil(time.Until(resetAt).Seconds()))
+	ctx.Header("Retry-After", strconv.Itoa(max(seconds, 0)))
+	response := map[string]any{"message": ErrQuotaExceeded.Error(), "resetAt": resetAt}
+	handleResponse(ctx, http.StatusTooManyRequests, response)
+	return false
+}
+
+// Record a request in the ledger. Failing to record it shouldn't
+// fail the request, since its tokens were already used up
+func (app *App) recordUsage(userId, action string, usage Usage) {
+	if usage == (Usage{}) {
+		return // the request never reached the llm
+	}
+	if err := app.db.recordUsage(userId, action, usage); err != nil {
+		log.Printf("recording the usage of %s failed: %v", userId, err)
+	}
+}
+
+func (app *App) GetUsage(ctx *gin.Context) {
+	userId, err := app.getUserID(ctx)
+	if err != nil {
+		handleResponse(ctx, http.StatusBadRequest, "Authentication required")
+		return
+	}
+
+	summary, err := app.getUsage(userId)
+	if err != nil {
+		handleResponse(ctx, http.StatusInternalServerError, nil)
+		return
+	}
+
+	handleResponse(ctx, http.StatusOK, summary)
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/wneessen/go-mail"
 )
@@ -20,6 +23,61 @@ func readEnvironmentVariables() map[string]string {
 	return values
 }
 
+// Parse an integer query parameter, falling back to a default value
+// when it's missing or malformed and clamping it to [lower, upper]
+func parseQueryInt(value string, fallback, lower, upper int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return min(max(n, lower), upper)
+}
+
+// Pagination cursors are opaque to clients, but are really
+// just a list of integers encoded in base64
+func encodeCursor(values ...int64) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.FormatInt(value, 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, ":")))
+}
+
+func decodeCursor(cursor string, count int) ([]int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != count {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+
+	values := make([]int64, count)
+	for i, part := range parts {
+		values[i], err = strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Run a job every interval in the background, logging its errors
+func runEvery(interval time.Duration, name string, job func() error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := job(); err != nil {
+				log.Printf("%s failed: %v", name, err)
+			}
+		}
+	}()
+}
+
 func parseTemplate(path string, data any) (string, error) {
 	t, err := template.ParseFiles(path)
 	if err != nil {
@@ -7,8 +7,7 @@ import { Eye, EyeOff } from "@tamagui/lucide-icons";
 
 import Page from "@/components/page";
 
-import request from "@/lib/http";
-import { useStringStorage  } from "@/lib/storage";
+import request, { storeTokens } from "@/lib/http";
 
 function PasswordInput(
   { setPassword, placeholder }:
@@ -33,8 +32,6 @@ function PasswordInput(
 }
 
 export default function AuthPage() {
-  const [_, setToken] = useStringStorage("jwt", "");
-
   const [email, setEmail] = useState("");
   const [password, setPassword] = useState("");
   const [repeatedPassword, setRepeatedPassword] = useState("");
@@ -100,8 +97,10 @@ export default function AuthPage() {
       const response = await request("POST", "/authenticate", payload);
       const json = await response.json();
 
-      if (response.status == 200) {
-        setToken(json["token"]);
+      if (response.status == 200 && json["twoFactorRequired"] == true) {
+        setError("Two-factor authentication isn't supported in the app yet");
+      } else if (response.status == 200) {
+        storeTokens(json);
         router.navigate("/");
       } else if (response.status == 406) {
         // signal a user error
@@ -1,4 +1,19 @@
-export default async function request(
+import storage from "@/lib/storage";
+
+// Access tokens are short lived, so they're refreshed a minute before they expire
+const refreshMargin = 60 * 1000;
+
+// Refresh tokens can only be used once, so concurrent requests share one refresh
+let refreshing: Promise<void> | undefined;
+
+// Store the tokens returned when logging in or refreshing
+export function storeTokens(json: any) {
+  storage.set("jwt", json["token"]);
+  storage.set("refreshToken", json["refreshToken"]);
+  storage.set("tokenExpiresAt", Date.now() + json["expiresIn"] * 1000);
+}
+
+async function send(
   method: string,
   endpoint: string,
   payload?: object | FormData,
@@ -22,4 +37,45 @@ export default async function request(
     method, headers,
     body: isForm ? payload : JSON.stringify(payload)
   });
-}
\ No newline at end of file
+}
+
+async function refreshTokens(): Promise<void> {
+  const refreshToken = storage.getString("refreshToken");
+  if (refreshToken === undefined) return;
+
+  const response = await send("POST", "/auth/refresh", { refreshToken });
+  if (response.status == 401) {
+    // The session is over, so the user has to log in again
+    storage.delete("refreshToken");
+    storage.delete("tokenExpiresAt");
+    return;
+  } else if (response.status != 200) {
+    return;
+  }
+
+  storeTokens(await response.json());
+}
+
+// Get an access token that isn't about to expire. Tokens from before
+// refresh tokens existed can't be refreshed, so they're used as is
+async function freshToken(token: string): Promise<string> {
+  const expiresAt = storage.getNumber("tokenExpiresAt");
+  if (expiresAt !== undefined && Date.now() >= expiresAt - refreshMargin) {
+    refreshing ??= refreshTokens().finally(() => { refreshing = undefined; });
+    await refreshing;
+  }
+
+  // Pages can hold on to a token that has since been refreshed
+  return storage.getString("jwt") ?? token;
+}
+
+export default async function request(
+  method: string,
+  endpoint: string,
+  payload?: object | FormData,
+  token?: string
+): Promise<Response> {
+  if (token !== undefined && token.length > 0)
+    token = await freshToken(token);
+  return await send(method, endpoint, payload, token);
+}